@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"proton-gateway/config"
+	"proton-gateway/discovery"
+	"proton-gateway/store"
+	"proton-gateway/topic"
+)
+
+// adoptedKey holds the devices adopted through discovery, which are handled
+// like configured devices after a restart.
+const adoptedKey = "discovery/adopted"
+
+func loadAdopted(conf *config.Config, state store.Store) {
+	var adopted []config.DeviceConfig
+	if _, err := state.Get(adoptedKey, &adopted); err != nil {
+		log.Warnf("error loading adopted devices: %v", err)
+		return
+	}
+
+	configured := make(map[string]bool)
+	for _, deviceConfig := range conf.Devices {
+		configured[deviceConfig.Mac] = true
+	}
+
+	for _, deviceConfig := range adopted {
+		if configured[deviceConfig.Mac] {
+			continue
+		}
+		// the name may be taken by a device configured since the adoption
+		if err := conf.CheckName(deviceConfig); err != nil {
+			log.Warnf("ignoring adopted device %s: %v", deviceConfig.Mac, err)
+			continue
+		}
+
+		conf.Inherit(&deviceConfig)
+		conf.Devices = append(conf.Devices, deviceConfig)
+	}
+}
+
+func rememberAdopted(state store.Store, deviceConfig config.DeviceConfig) {
+	var adopted []config.DeviceConfig
+	_, _ = state.Get(adoptedKey, &adopted)
+
+	if err := state.Set(adoptedKey, append(adopted, deviceConfig)); err != nil {
+		log.Errorf("error remembering adopted device %s: %v", deviceConfig.Mac, err)
+	}
+}
+
+func subscribeAdoptions(client mqtt.Client, layout *topic.Layout, disc *discovery.Discovery) {
+	client.Subscribe(discovery.AdoptTopic(layout), 0, func(client mqtt.Client, m mqtt.Message) {
+		adoption := discovery.Adoption{}
+		if err := json.Unmarshal(m.Payload(), &adoption); err != nil {
+			log.Warnf("invalid adoption request: %v", err)
+			return
+		}
+
+		if err := disc.Adopt(adoption); err != nil {
+			log.Warnf("error adopting device %s: %v", adoption.Mac, err)
+		}
+	})
+}
+
+func serveDiscovery(ctx context.Context, address string, disc *discovery.Discovery) {
+	mux := http.NewServeMux()
+	mux.Handle("/devices/pending", disc)
+	server := &http.Server{Addr: address, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	log.Infof("serving discovery api on %s", address)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Errorf("error serving discovery api: %v", err)
+	}
+}
@@ -0,0 +1,269 @@
+package aggregate
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"proton-gateway/config"
+	"proton-gateway/homeassistant"
+	"proton-gateway/message"
+	"proton-gateway/topic"
+	"sort"
+	"strings"
+	"time"
+)
+
+var DefaultWindows = []time.Duration{5 * time.Minute, time.Hour, 24 * time.Hour}
+
+const DefaultInterval = time.Minute
+
+var statNames = map[string]string{
+	"min":  "Min",
+	"max":  "Max",
+	"mean": "Mean",
+}
+
+// Stats summarizes the values of one field within a window.
+type Stats struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Mean  float64 `json:"mean"`
+	Count int     `json:"count"`
+}
+
+type sample struct {
+	at    time.Time
+	value float64
+}
+
+// Aggregator keeps the recent numeric values of a device's state and
+// publishes rolling statistics over each window to <state topic>/stats/<window>,
+// with a trailing /state of the state topic left out.
+type Aggregator struct {
+	windows       []time.Duration
+	fields        map[string]bool
+	interval      time.Duration
+	homeAssistant bool
+	layout        *topic.Layout
+	device        topic.Device
+	base          string
+
+	samples     map[string][]sample
+	publishedAt time.Time
+}
+
+func New(conf config.AggregationConfig, layout *topic.Layout, device topic.Device, stateTopic string) *Aggregator {
+	windows := append([]time.Duration(nil), conf.Windows...)
+	if len(windows) == 0 {
+		windows = append([]time.Duration(nil), DefaultWindows...)
+	}
+	sort.Slice(windows, func(i, j int) bool {
+		return windows[i] < windows[j]
+	})
+
+	var fields map[string]bool
+	if len(conf.Fields) > 0 {
+		fields = make(map[string]bool)
+		for _, field := range conf.Fields {
+			fields[field] = true
+		}
+	}
+
+	interval := conf.Interval
+	if interval == 0 {
+		interval = DefaultInterval
+	}
+
+	return &Aggregator{
+		windows:       windows,
+		fields:        fields,
+		interval:      interval,
+		homeAssistant: conf.HomeAssistant,
+		layout:        layout,
+		device:        device,
+		base:          strings.TrimSuffix(stateTopic, "/state"),
+		samples:       make(map[string][]sample),
+	}
+}
+
+// Add records the values of a state received at now.
+func (a *Aggregator) Add(now time.Time, payload []byte) {
+	values := make(map[string]interface{})
+	if err := json.Unmarshal(payload, &values); err != nil {
+		return
+	}
+
+	for field, value := range values {
+		number, ok := value.(float64)
+		if !ok || !a.aggregated(field) {
+			continue
+		}
+		a.insert(field, sample{now, number})
+	}
+}
+
+// insert keeps the samples of a field ordered by time, as packets relayed by
+// several gateways or replayed may arrive out of order.
+func (a *Aggregator) insert(field string, s sample) {
+	samples := a.samples[field]
+	i := sort.Search(len(samples), func(i int) bool {
+		return samples[i].at.After(s.at)
+	})
+
+	samples = append(samples, sample{})
+	copy(samples[i+1:], samples[i:])
+	samples[i] = s
+	a.samples[field] = samples
+}
+
+// Publish returns the statistics messages once interval passed since they
+// were last published, starting with the first recorded state. Fields
+// without samples in a window are left out of its statistics, so a silent
+// device ends up publishing empty windows.
+func (a *Aggregator) Publish(now time.Time) []message.Message {
+	a.prune(now)
+
+	if a.publishedAt.IsZero() && len(a.samples) == 0 {
+		return nil
+	}
+	if !a.publishedAt.IsZero() && now.Sub(a.publishedAt) < a.interval {
+		return nil
+	}
+	a.publishedAt = now
+
+	messages := make([]message.Message, 0, len(a.windows))
+	for _, window := range a.windows {
+		msg, err := message.Json(a.topic(window), a.stats(now, window), false, 0)
+		if err != nil {
+			continue
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages
+}
+
+func (a *Aggregator) aggregated(field string) bool {
+	return a.fields == nil || a.fields[field]
+}
+
+// prune drops samples which left the longest window.
+func (a *Aggregator) prune(now time.Time) {
+	oldest := now.Add(-a.windows[len(a.windows)-1])
+	for field, samples := range a.samples {
+		i := sort.Search(len(samples), func(i int) bool {
+			return samples[i].at.After(oldest)
+		})
+		if i == len(samples) {
+			delete(a.samples, field)
+			continue
+		}
+		a.samples[field] = samples[i:]
+	}
+}
+
+func (a *Aggregator) stats(now time.Time, window time.Duration) map[string]Stats {
+	start := now.Add(-window)
+
+	stats := make(map[string]Stats)
+	for field, samples := range a.samples {
+		s := Stats{Min: math.Inf(1), Max: math.Inf(-1)}
+		sum := 0.0
+		for _, sample := range samples {
+			if !sample.at.After(start) {
+				continue
+			}
+			s.Min = math.Min(s.Min, sample.value)
+			s.Max = math.Max(s.Max, sample.value)
+			sum += sample.value
+			s.Count++
+		}
+
+		if s.Count > 0 {
+			s.Mean = sum / float64(s.Count)
+			stats[field] = s
+		}
+	}
+
+	return stats
+}
+
+// Topics returns the topics the statistics are published to.
+func (a *Aggregator) Topics() []string {
+	topics := make([]string, 0, len(a.windows))
+	for _, window := range a.windows {
+		topics = append(topics, a.topic(window))
+	}
+
+	return topics
+}
+
+func (a *Aggregator) topic(window time.Duration) string {
+	return fmt.Sprintf("%s/stats/%s", a.base, WindowName(window))
+}
+
+// Configuration announces min, max and mean of every window as Home Assistant
+// sensors, derived from the device's sensors of the aggregated fields.
+func (a *Aggregator) Configuration(discovery []message.Message) []message.Message {
+	if !a.homeAssistant {
+		return nil
+	}
+
+	var messages []message.Message
+	for _, msg := range discovery {
+		entity := make(map[string]interface{})
+		if err := json.Unmarshal(msg.Payload(), &entity); err != nil {
+			continue
+		}
+
+		// unique ids are <device id>_<field>, sensors of other entity types
+		// are told apart by their discovery topic
+		uniqueId, _ := entity["unique_id"].(string)
+		field := strings.TrimPrefix(uniqueId, a.device.Id+"_")
+		if msg.Topic() != homeassistant.AutoDiscoveryTopic(a.layout, homeassistant.EntityTypeSensor, a.device, field) || !a.aggregated(field) {
+			continue
+		}
+
+		for _, window := range a.windows {
+			for _, stat := range []string{"min", "max", "mean"} {
+				entity := make(map[string]interface{})
+				_ = json.Unmarshal(msg.Payload(), &entity)
+
+				suffix := fmt.Sprintf("%s_%s", WindowName(window), stat)
+				object := fmt.Sprintf("%s_%s_%s", a.device.Id, field, suffix)
+				entity["object_id"] = object
+				entity["unique_id"] = object
+				entity["name"] = fmt.Sprintf("%v %s %s", entity["name"], WindowName(window), statNames[stat])
+				entity["state_topic"] = a.topic(window)
+				// a window without samples leaves the sensor unknown
+				entity["value_template"] = fmt.Sprintf("{{ value_json.%s.%s | round(2) if value_json.%s is defined else None }}", field, stat, field)
+				delete(entity, "expire_after")
+
+				config, err := message.Json(
+					homeassistant.AutoDiscoveryTopic(a.layout, homeassistant.EntityTypeSensor, a.device, fmt.Sprintf("%s_%s", field, suffix)),
+					entity,
+					true,
+					0,
+				)
+				if err != nil {
+					continue
+				}
+				messages = append(messages, config)
+			}
+		}
+	}
+
+	return messages
+}
+
+// WindowName formats a window like 5m, 1h or 24h.
+func WindowName(window time.Duration) string {
+	switch {
+	case window%time.Hour == 0:
+		return fmt.Sprintf("%dh", window/time.Hour)
+	case window%time.Minute == 0:
+		return fmt.Sprintf("%dm", window/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", window/time.Second)
+	}
+}
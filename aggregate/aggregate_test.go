@@ -0,0 +1,223 @@
+package aggregate
+
+import (
+	"encoding/json"
+	"proton-gateway/config"
+	"proton-gateway/topic"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func defaultLayout(t *testing.T) *topic.Layout {
+	layout, err := topic.NewLayout(config.TopicsConfig{})
+	if err != nil {
+		t.Fatalf("topic.NewLayout() = %v", err)
+	}
+
+	return layout
+}
+
+type testSample struct {
+	at      time.Duration
+	payload string
+}
+
+func TestAggregatorStats(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    config.AggregationConfig
+		samples []testSample
+		at      time.Duration
+		// statistics by window name, then field
+		want map[string]map[string]Stats
+	}{
+		{
+			"min max mean",
+			config.AggregationConfig{Windows: []time.Duration{5 * time.Minute}},
+			[]testSample{
+				{time.Minute, `{"temperature":20}`},
+				{2 * time.Minute, `{"temperature":23}`},
+				{3 * time.Minute, `{"temperature":26}`},
+			},
+			4 * time.Minute,
+			map[string]map[string]Stats{
+				"5m": {"temperature": {Min: 20, Max: 26, Mean: 23, Count: 3}},
+			},
+		},
+		{
+			"windows",
+			config.AggregationConfig{Windows: []time.Duration{time.Hour, 5 * time.Minute}},
+			[]testSample{
+				{time.Minute, `{"temperature":10}`},
+				{20 * time.Minute, `{"temperature":20}`},
+				{22 * time.Minute, `{"temperature":30}`},
+			},
+			24 * time.Minute,
+			map[string]map[string]Stats{
+				"5m": {"temperature": {Min: 20, Max: 30, Mean: 25, Count: 2}},
+				"1h": {"temperature": {Min: 10, Max: 30, Mean: 20, Count: 3}},
+			},
+		},
+		{
+			"sample on the window start is left out",
+			config.AggregationConfig{Windows: []time.Duration{5 * time.Minute}},
+			[]testSample{
+				{time.Minute, `{"temperature":10}`},
+				{2 * time.Minute, `{"temperature":20}`},
+			},
+			6 * time.Minute,
+			map[string]map[string]Stats{
+				"5m": {"temperature": {Min: 20, Max: 20, Mean: 20, Count: 1}},
+			},
+		},
+		{
+			"empty window",
+			config.AggregationConfig{Windows: []time.Duration{5 * time.Minute, time.Hour}},
+			[]testSample{
+				{time.Minute, `{"temperature":10}`},
+			},
+			10 * time.Minute,
+			map[string]map[string]Stats{
+				"5m": {},
+				"1h": {"temperature": {Min: 10, Max: 10, Mean: 10, Count: 1}},
+			},
+		},
+		{
+			"out of order",
+			config.AggregationConfig{Windows: []time.Duration{5 * time.Minute}},
+			[]testSample{
+				{20 * time.Minute, `{"temperature":20}`},
+				{time.Minute, `{"temperature":-40}`},
+				{19 * time.Minute, `{"temperature":10}`},
+			},
+			21 * time.Minute,
+			map[string]map[string]Stats{
+				"5m": {"temperature": {Min: 10, Max: 20, Mean: 15, Count: 2}},
+			},
+		},
+		{
+			"out of order within windows",
+			config.AggregationConfig{Windows: []time.Duration{5 * time.Minute, time.Hour}},
+			[]testSample{
+				{10 * time.Minute, `{"temperature":30}`},
+				{2 * time.Minute, `{"temperature":10}`},
+				{8 * time.Minute, `{"temperature":20}`},
+			},
+			11 * time.Minute,
+			map[string]map[string]Stats{
+				"5m": {"temperature": {Min: 20, Max: 30, Mean: 25, Count: 2}},
+				"1h": {"temperature": {Min: 10, Max: 30, Mean: 20, Count: 3}},
+			},
+		},
+		{
+			"numeric fields only",
+			config.AggregationConfig{Windows: []time.Duration{5 * time.Minute}},
+			[]testSample{
+				{time.Minute, `{"temperature":20,"battery_low":true,"label":"x"}`},
+			},
+			2 * time.Minute,
+			map[string]map[string]Stats{
+				"5m": {"temperature": {Min: 20, Max: 20, Mean: 20, Count: 1}},
+			},
+		},
+		{
+			"configured fields",
+			config.AggregationConfig{Windows: []time.Duration{5 * time.Minute}, Fields: []string{"humidity"}},
+			[]testSample{
+				{time.Minute, `{"temperature":20,"humidity":40}`},
+				{2 * time.Minute, `{"temperature":21,"humidity":50}`},
+			},
+			3 * time.Minute,
+			map[string]map[string]Stats{
+				"5m": {"humidity": {Min: 40, Max: 50, Mean: 45, Count: 2}},
+			},
+		},
+		{
+			"not json",
+			config.AggregationConfig{Windows: []time.Duration{5 * time.Minute}},
+			[]testSample{
+				{time.Minute, `{"temperature":20}`},
+				{2 * time.Minute, `offline`},
+			},
+			3 * time.Minute,
+			map[string]map[string]Stats{
+				"5m": {"temperature": {Min: 20, Max: 20, Mean: 20, Count: 1}},
+			},
+		},
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			aggregator := New(test.conf, defaultLayout(t), topic.Device{Id: "test"}, "protons/test/state")
+			for _, sample := range test.samples {
+				aggregator.Add(start.Add(sample.at), []byte(sample.payload))
+			}
+
+			messages := aggregator.Publish(start.Add(test.at))
+			if len(messages) != len(test.want) {
+				t.Fatalf("Publish() = %d messages, want %d", len(messages), len(test.want))
+			}
+
+			for _, msg := range messages {
+				var got map[string]Stats
+				if err := json.Unmarshal(msg.Payload(), &got); err != nil {
+					t.Fatalf("Publish() payload %s: %v", msg.Payload(), err)
+				}
+
+				window := msg.Topic()[len("protons/test/stats/"):]
+				if want := test.want[window]; !reflect.DeepEqual(got, want) {
+					t.Errorf("stats of %s = %v, want %v", window, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAggregatorPublishInterval(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	aggregator := New(config.AggregationConfig{
+		Windows:  []time.Duration{5 * time.Minute},
+		Interval: time.Minute,
+	}, defaultLayout(t), topic.Device{Id: "test"}, "protons/test/state")
+
+	if messages := aggregator.Publish(start); messages != nil {
+		t.Errorf("Publish() before the first state = %v, want nothing", messages)
+	}
+
+	aggregator.Add(start, []byte(`{"temperature":20}`))
+	steps := []struct {
+		at   time.Duration
+		want int
+	}{
+		{0, 1},
+		{30 * time.Second, 0},
+		{time.Minute, 1},
+		// the silent device keeps publishing its empty window
+		{10 * time.Minute, 1},
+	}
+	for _, step := range steps {
+		if messages := aggregator.Publish(start.Add(step.at)); len(messages) != step.want {
+			t.Errorf("Publish(%s) = %d messages, want %d", step.at, len(messages), step.want)
+		}
+	}
+}
+
+func TestWindowName(t *testing.T) {
+	tests := []struct {
+		window time.Duration
+		want   string
+	}{
+		{30 * time.Second, "30s"},
+		{5 * time.Minute, "5m"},
+		{90 * time.Minute, "90m"},
+		{24 * time.Hour, "24h"},
+	}
+
+	for _, test := range tests {
+		if name := WindowName(test.window); name != test.want {
+			t.Errorf("WindowName(%s) = %q, want %q", test.window, name, test.want)
+		}
+	}
+}
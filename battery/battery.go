@@ -0,0 +1,125 @@
+package battery
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Point maps a battery voltage to a charge level in percent.
+type Point struct {
+	Voltage float64 `yaml:"voltage"`
+	Level   float64 `yaml:"level"`
+}
+
+// Profile is a discharge curve, ordered by voltage. Levels between points are
+// interpolated linearly and clamped to 0-100 %. The level of a voltage which
+// is NaN or infinite is unknown and reported as NaN.
+type Profile []Point
+
+const (
+	ProfileLinear   = "linear"
+	ProfileLipo     = "lipo"
+	ProfileLifepo4  = "lifepo4"
+	ProfileAlkaline = "2xaa-alkaline"
+	ProfileCustom   = "custom"
+)
+
+var profiles = map[string]Profile{
+	// matches the former voltage*100-320 of the ht sensor
+	ProfileLinear: {
+		{3.2, 0}, {4.2, 100},
+	},
+	ProfileLipo: {
+		{3.27, 0}, {3.61, 5}, {3.69, 10}, {3.71, 15}, {3.73, 20}, {3.75, 25},
+		{3.77, 30}, {3.79, 35}, {3.80, 40}, {3.82, 45}, {3.84, 50}, {3.85, 55},
+		{3.87, 60}, {3.91, 65}, {3.95, 70}, {3.98, 75}, {4.02, 80}, {4.08, 85},
+		{4.11, 90}, {4.15, 95}, {4.20, 100},
+	},
+	ProfileLifepo4: {
+		{2.50, 0}, {3.00, 10}, {3.20, 20}, {3.22, 30}, {3.25, 40}, {3.27, 50},
+		{3.30, 60}, {3.32, 70}, {3.35, 80}, {3.40, 90}, {3.60, 100},
+	},
+	ProfileAlkaline: {
+		{2.00, 0}, {2.20, 10}, {2.36, 25}, {2.50, 50}, {2.64, 75}, {2.80, 90},
+		{3.00, 100},
+	},
+}
+
+var ErrUnknownProfile = errors.New("battery: unknown profile")
+var ErrInvalidProfile = errors.New("battery: profile needs at least two finite points of distinct voltage")
+
+// Lookup returns the named profile, or a profile built from points for
+// ProfileCustom.
+func Lookup(name string, points []Point) (Profile, error) {
+	if name == ProfileCustom {
+		return NewProfile(points)
+	}
+
+	profile, found := profiles[name]
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProfile, name)
+	}
+
+	return profile, nil
+}
+
+func NewProfile(points []Point) (Profile, error) {
+	profile := append(Profile(nil), points...)
+	sort.Slice(profile, func(i, j int) bool {
+		return profile[i].Voltage < profile[j].Voltage
+	})
+
+	if len(profile) < 2 {
+		return nil, ErrInvalidProfile
+	}
+	for i, point := range profile {
+		if !finite(point.Voltage) || !finite(point.Level) {
+			return nil, ErrInvalidProfile
+		}
+		if i > 0 && point.Voltage == profile[i-1].Voltage {
+			return nil, ErrInvalidProfile
+		}
+	}
+
+	return profile, nil
+}
+
+func (profile Profile) Level(voltage float64) float64 {
+	if !finite(voltage) {
+		return math.NaN()
+	}
+
+	i := sort.Search(len(profile), func(i int) bool {
+		return profile[i].Voltage >= voltage
+	})
+
+	var level float64
+	switch {
+	case i == 0:
+		level = profile[0].Level
+	case i == len(profile):
+		level = profile[len(profile)-1].Level
+	default:
+		low, high := profile[i-1], profile[i]
+		level = low.Level + (voltage-low.Voltage)*(high.Level-low.Level)/(high.Voltage-low.Voltage)
+	}
+
+	return clamp(level)
+}
+
+func clamp(level float64) float64 {
+	if level < 0 {
+		return 0
+	}
+	if level > 100 {
+		return 100
+	}
+
+	return level
+}
+
+func finite(value float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0)
+}
@@ -0,0 +1,103 @@
+package battery
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestProfileLevel(t *testing.T) {
+	custom, err := NewProfile([]Point{{3.0, 100}, {2.0, 0}, {2.5, 80}})
+	if err != nil {
+		t.Fatalf("NewProfile() = %v", err)
+	}
+	linear, _ := Lookup(ProfileLinear, nil)
+
+	tests := []struct {
+		name    string
+		profile Profile
+		voltage float64
+		want    float64
+	}{
+		{"linear at lowest point", linear, 3.2, 0},
+		{"linear midway", linear, 3.7, 50},
+		{"linear at highest point", linear, 4.2, 100},
+		{"linear below range", linear, 2.0, 0},
+		{"linear above range", linear, 5.0, 100},
+		{"custom on a point", custom, 2.5, 80},
+		{"custom interpolated below", custom, 2.25, 40},
+		{"custom interpolated above", custom, 2.75, 90},
+		{"custom below range", custom, 1.0, 0},
+		{"custom above range", custom, 3.5, 100},
+		{"not a number", linear, math.NaN(), math.NaN()},
+		{"positive infinity", linear, math.Inf(1), math.NaN()},
+		{"negative infinity", linear, math.Inf(-1), math.NaN()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			level := test.profile.Level(test.voltage)
+			if math.IsNaN(test.want) {
+				if !math.IsNaN(level) {
+					t.Errorf("Level(%v) = %v, want NaN", test.voltage, level)
+				}
+				return
+			}
+			if math.Abs(level-test.want) > 1e-9 {
+				t.Errorf("Level(%v) = %v, want %v", test.voltage, level, test.want)
+			}
+		})
+	}
+}
+
+// TestProfileLevelClamps checks that a profile reaching beyond 0-100 % is
+// clamped.
+func TestProfileLevelClamps(t *testing.T) {
+	profile, err := NewProfile([]Point{{1.0, -50}, {2.0, 150}})
+	if err != nil {
+		t.Fatalf("NewProfile() = %v", err)
+	}
+
+	tests := []struct {
+		voltage float64
+		want    float64
+	}{
+		{1.0, 0},
+		{1.2, 0},
+		{1.5, 50},
+		{1.8, 100},
+		{2.0, 100},
+	}
+
+	for _, test := range tests {
+		if level := profile.Level(test.voltage); math.Abs(level-test.want) > 1e-9 {
+			t.Errorf("Level(%v) = %v, want %v", test.voltage, level, test.want)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile string
+		points  []Point
+		wantErr error
+	}{
+		{"builtin", ProfileLipo, nil, nil},
+		{"unknown", "nimh", nil, ErrUnknownProfile},
+		{"custom", ProfileCustom, []Point{{2.0, 0}, {3.0, 100}}, nil},
+		{"custom single point", ProfileCustom, []Point{{2.0, 0}}, ErrInvalidProfile},
+		{"custom same voltage", ProfileCustom, []Point{{2.0, 0}, {2.0, 100}}, ErrInvalidProfile},
+		{"custom not a number", ProfileCustom, []Point{{2.0, 0}, {math.NaN(), 100}}, ErrInvalidProfile},
+		{"custom infinite level", ProfileCustom, []Point{{2.0, 0}, {3.0, math.Inf(1)}}, ErrInvalidProfile},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Lookup(test.profile, test.points)
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("Lookup() = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"proton-gateway/config"
+	"proton-gateway/device"
+	"proton-gateway/message"
+	"proton-gateway/topic"
+	"sort"
+	"sync"
+	"time"
+)
+
+// retainingClient remembers the last message published to every topic, so
+// discovery, states and availability can be sent again once Home Assistant
+// restarts. States are not retained by the broker, so they are kept here too.
+// It also remembers the subscriptions, which the clean session drops whenever
+// the connection to the broker is lost.
+type retainingClient struct {
+	mqtt.Client
+
+	layout        *topic.Layout
+	lock          sync.Mutex
+	last          map[string]message.Message
+	subscriptions map[string]subscription
+}
+
+type subscription struct {
+	qos      byte
+	callback mqtt.MessageHandler
+}
+
+func newRetainingClient(layout *topic.Layout) *retainingClient {
+	return &retainingClient{
+		layout:        layout,
+		last:          make(map[string]message.Message),
+		subscriptions: make(map[string]subscription),
+	}
+}
+
+// connect connects the bridge and subscribes again on every reconnect.
+func (client *retainingClient) connect(conf config.MqttConfig) {
+	client.Client = connectMqtt(conf, client.layout, client.resubscribe)
+}
+
+func (client *retainingClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	client.lock.Lock()
+	client.subscriptions[topic] = subscription{qos, callback}
+	client.lock.Unlock()
+
+	return client.Client.Subscribe(topic, qos, callback)
+}
+
+// resubscribe runs on every connect, before any subscription on the first.
+func (client *retainingClient) resubscribe(connected mqtt.Client) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	for topic, sub := range client.subscriptions {
+		connected.Subscribe(topic, sub.qos, sub.callback)
+	}
+}
+
+func (client *retainingClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var data []byte
+	switch p := payload.(type) {
+	case []byte:
+		data = p
+	case string:
+		data = []byte(p)
+	}
+
+	client.lock.Lock()
+	if retained && len(data) == 0 {
+		// an empty retained payload clears the topic
+		delete(client.last, topic)
+	} else {
+		client.last[topic] = message.NewMessage(topic, data, retained, qos)
+	}
+	client.lock.Unlock()
+
+	return client.Client.Publish(topic, qos, retained, payload)
+}
+
+// remember records a message to republish without publishing it now.
+func (client *retainingClient) remember(msg message.Message) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if _, found := client.last[msg.Topic()]; !found {
+		client.last[msg.Topic()] = msg
+	}
+}
+
+// rememberStates seeds the republish with the states devices restored, so
+// Home Assistant gets them even before the first packet after a restart.
+func rememberStates(client *retainingClient, devices map[string]device.Device) {
+	for _, dev := range devices {
+		if remembering, ok := dev.(device.Remembering); ok {
+			for _, msg := range remembering.LastState() {
+				client.remember(msg)
+			}
+		}
+	}
+}
+
+// republish publishes the remembered messages again, discovery configurations
+// first so Home Assistant knows the entities before their states arrive.
+func (client *retainingClient) republish() {
+	client.lock.Lock()
+	messages := make([]message.Message, 0, len(client.last))
+	for _, msg := range client.last {
+		messages = append(messages, msg)
+	}
+	client.lock.Unlock()
+
+	sort.Slice(messages, func(i, j int) bool {
+		iConfig, jConfig := client.layout.IsDiscovery(messages[i].Topic()), client.layout.IsDiscovery(messages[j].Topic())
+		if iConfig != jConfig {
+			return iConfig
+		}
+		return messages[i].Topic() < messages[j].Topic()
+	})
+
+	for _, msg := range messages {
+		publish(client.Client, msg)
+	}
+}
+
+// subscribeBirth republishes everything retained whenever Home Assistant
+// announces it is online.
+func subscribeBirth(client *retainingClient, conf config.HomeAssistantConfig) {
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	client.Subscribe(conf.StatusTopic, 0, func(_ mqtt.Client, m mqtt.Message) {
+		if string(m.Payload()) != "online" {
+			return
+		}
+
+		delay := time.Duration(0)
+		if conf.Jitter > 0 {
+			delay = time.Duration(random.Int63n(int64(conf.Jitter)))
+		}
+		go func() {
+			time.Sleep(delay)
+			log.Infof("home assistant is online, republishing configuration and states")
+			client.republish()
+		}()
+	})
+}
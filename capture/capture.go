@@ -0,0 +1,178 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"proton-gateway/packet"
+	"proton-gateway/utils"
+	"sync"
+	"time"
+)
+
+// A capture file starts with magic followed by records of
+//
+//	int64   timestamp, unix nanoseconds, big endian
+//	[6]byte mac
+//	int8    rssi
+//	uint8   gateway name length, followed by the name
+//	uint8   payload length, followed by the payload
+var magic = []byte("PGCAP\x01")
+
+var ErrInvalidCapture = errors.New("capture: not a capture file")
+var ErrFieldTooLong = errors.New("capture: field too long")
+
+type Writer struct {
+	lock   sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// Create opens path for appending, writing the file header if it is new.
+func Create(path string) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	if info.Size() == 0 {
+		_, err = file.Write(magic)
+	} else {
+		err = checkMagic(file)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return &Writer{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+// Write appends p and flushes it, so a crash loses at most the record being
+// written.
+func (w *Writer) Write(p packet.Packet) error {
+	mac, err := utils.ParseMac(p.Mac())
+	if err != nil {
+		return err
+	}
+	if len(p.Gateway()) > 0xff || len(p.Payload()) > 0xff {
+		return ErrFieldTooLong
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	_ = binary.Write(w.writer, binary.BigEndian, p.Timestamp().UnixNano())
+	_, _ = w.writer.Write(mac)
+	_ = binary.Write(w.writer, binary.BigEndian, p.Rssi())
+	_ = w.writer.WriteByte(uint8(len(p.Gateway())))
+	_, _ = w.writer.WriteString(p.Gateway())
+	_ = w.writer.WriteByte(uint8(len(p.Payload())))
+	_, _ = w.writer.Write(p.Payload())
+
+	return w.writer.Flush()
+}
+
+func (w *Writer) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if err := w.writer.Flush(); err != nil {
+		_ = w.file.Close()
+		return err
+	}
+
+	return w.file.Close()
+}
+
+type Reader struct {
+	file   *os.File
+	reader *bufio.Reader
+}
+
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkMagic(file); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return &Reader{file: file, reader: bufio.NewReader(file)}, nil
+}
+
+// Next returns the next recorded packet, io.EOF at the end of the capture
+// and io.ErrUnexpectedEOF if the last record was cut short.
+func (r *Reader) Next() (packet.Packet, error) {
+	var timestamp int64
+	if err := binary.Read(r.reader, binary.BigEndian, &timestamp); err != nil {
+		return nil, err
+	}
+
+	mac := make([]byte, 6)
+	var rssi int8
+	if _, err := io.ReadFull(r.reader, mac); err != nil {
+		return nil, unexpected(err)
+	}
+	if err := binary.Read(r.reader, binary.BigEndian, &rssi); err != nil {
+		return nil, unexpected(err)
+	}
+
+	gateway, err := r.field()
+	if err != nil {
+		return nil, err
+	}
+	payload, err := r.field()
+	if err != nil {
+		return nil, err
+	}
+
+	return packet.New(hex.EncodeToString(mac), time.Unix(0, timestamp), payload, string(gateway), rssi), nil
+}
+
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
+
+func (r *Reader) field() ([]byte, error) {
+	length, err := r.reader.ReadByte()
+	if err != nil {
+		return nil, unexpected(err)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r.reader, data); err != nil {
+		return nil, unexpected(err)
+	}
+
+	return data, nil
+}
+
+func checkMagic(file *os.File) error {
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(file, header); err != nil || string(header) != string(magic) {
+		return ErrInvalidCapture
+	}
+
+	return nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+	"proton-gateway/homeassistant"
+	"proton-gateway/message"
+	"proton-gateway/store"
+	"proton-gateway/topic"
+	"sort"
+	"sync"
+	"time"
+)
+
+// discoveryKey holds the manifest of discovery topics announced by the bridge,
+// which are cleared once their device or gateway is gone.
+const discoveryKey = "homeassistant/discovery"
+
+// retainedWait is how long purge waits for the retained status of the bridge.
+const retainedWait = 2 * time.Second
+
+// discoveryManifest maps the MAC of every device, and the name of every
+// gateway, to the discovery topics announced for it. Gateways are announced
+// from their own goroutine once connected, so access is guarded by a lock.
+type discoveryManifest struct {
+	layout *topic.Layout
+	lock   sync.Mutex
+	topics map[string][]string
+}
+
+func newDiscoveryManifest(layout *topic.Layout) *discoveryManifest {
+	return &discoveryManifest{layout: layout, topics: make(map[string][]string)}
+}
+
+// add records the discovery topics of configuration for key and returns the
+// topics previously announced for key which are no longer part of it.
+func (manifest *discoveryManifest) add(key string, configuration []message.Message) []string {
+	var topics []string
+	current := make(map[string]bool)
+	for _, msg := range configuration {
+		if manifest.layout.IsDiscovery(msg.Topic()) {
+			topics = append(topics, msg.Topic())
+			current[msg.Topic()] = true
+		}
+	}
+	sort.Strings(topics)
+
+	manifest.lock.Lock()
+	defer manifest.lock.Unlock()
+
+	var stale []string
+	for _, topic := range manifest.topics[key] {
+		if !current[topic] {
+			stale = append(stale, topic)
+		}
+	}
+	manifest.topics[key] = topics
+	return stale
+}
+
+// gatewayKey is the manifest key of a gateway. Unlike its MAC the name is
+// known before the gateway is connected.
+func gatewayKey(name string) string {
+	return "gateway-" + name
+}
+
+// loadDiscovery returns the manifest saved by the previous run.
+func loadDiscovery(state store.Store) map[string][]string {
+	owned := make(map[string][]string)
+	if _, err := state.Get(discoveryKey, &owned); err != nil {
+		log.Warnf("error loading discovery manifest: %v", err)
+	}
+	return owned
+}
+
+// cleanupDiscovery clears the topics owned by the previous run which were not
+// announced again. Devices and gateways still configured but not announced,
+// like those failing to start, keep their entities.
+func cleanupDiscovery(client mqtt.Client, state store.Store, manifest *discoveryManifest, owned map[string][]string, configured map[string]bool) {
+	manifest.lock.Lock()
+	current := make(map[string]bool)
+	for _, topics := range manifest.topics {
+		for _, topic := range topics {
+			current[topic] = true
+		}
+	}
+
+	var stale []string
+	for key, topics := range owned {
+		if _, announced := manifest.topics[key]; !announced && configured[key] {
+			manifest.topics[key] = topics
+			continue
+		}
+
+		for _, topic := range topics {
+			if !current[topic] {
+				stale = append(stale, topic)
+			}
+		}
+	}
+	manifest.lock.Unlock()
+
+	clearDiscovery(client, stale)
+	rememberDiscovery(state, manifest)
+}
+
+func clearDiscovery(client mqtt.Client, topics []string) {
+	for _, topic := range topics {
+		log.Infof("removing stale discovery topic %s", topic)
+		publish(client, message.NewMessage(topic, nil, true, 0))
+	}
+}
+
+func rememberDiscovery(state store.Store, manifest *discoveryManifest) {
+	manifest.lock.Lock()
+	defer manifest.lock.Unlock()
+
+	if err := state.Set(discoveryKey, manifest.topics); err != nil {
+		log.Errorf("error saving discovery manifest: %v", err)
+	}
+}
+
+// purge removes every entity the bridge announced from Home Assistant.
+func purge(args []string) {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	configFile := flags.String("config", "config.yaml", "configuration file")
+	_ = flags.Parse(args)
+
+	conf, layout := loadConfig(*configFile)
+	state := openStore(conf.State.Path)
+
+	owned := make(map[string][]string)
+	if _, err := state.Get(discoveryKey, &owned); err != nil {
+		log.Fatalf("error loading discovery manifest: %v", err)
+	}
+
+	client := connectMqttTool(conf.Mqtt, "purge")
+	// a running bridge saves its manifest again and announces everything
+	// once Home Assistant restarts
+	if bridgeOnline(client, layout) {
+		client.Disconnect(uint(disconnectQuiesce.Milliseconds()))
+		log.Fatalf("bridge is online, stop it before purging")
+	}
+
+	count := 0
+	for _, topics := range owned {
+		for _, topic := range topics {
+			log.Infof("removing discovery topic %s", topic)
+			publish(client, message.NewMessage(topic, nil, true, 0))
+			count++
+		}
+	}
+	publish(client, message.NewMessage(homeassistant.BridgeStatusTopic(layout), nil, true, 1))
+	client.Disconnect(uint(disconnectQuiesce.Milliseconds()))
+
+	state.Delete(discoveryKey)
+	if err := state.Flush(); err != nil {
+		log.Fatalf("error flushing state store: %v", err)
+	}
+	log.Infof("removed %d discovery topics", count)
+}
+
+// bridgeOnline reports whether the retained status of the bridge is online.
+// Without a retained status within retainedWait the bridge is taken as
+// offline.
+func bridgeOnline(client mqtt.Client, layout *topic.Layout) bool {
+	status := make(chan string, 1)
+	token := client.Subscribe(homeassistant.BridgeStatusTopic(layout), 1, func(_ mqtt.Client, m mqtt.Message) {
+		select {
+		case status <- string(m.Payload()):
+		default:
+		}
+	})
+	if token.Wait() && token.Error() != nil {
+		log.Fatalf("error reading bridge status: %v", token.Error())
+	}
+	defer client.Unsubscribe(homeassistant.BridgeStatusTopic(layout))
+
+	select {
+	case s := <-status:
+		return s == "online"
+	case <-time.After(retainedWait):
+		return false
+	}
+}
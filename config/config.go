@@ -1,30 +1,215 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"github.com/creasty/defaults"
+	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 	"io"
+	"proton-gateway/battery"
+	"proton-gateway/utils"
+	"regexp"
+	"strings"
+	"time"
 )
 
+const DefaultGatewayName = "default"
+
+var ErrInvalidCalibration = errors.New("config: calibration needs exactly two distinct points")
+var ErrUnknownScheme = errors.New("config: mqtt scheme unknown")
+var ErrInvalidGateway = errors.New("config: gateway name empty, duplicate or not usable in topics")
+var ErrInvalidPublishing = errors.New("config: publishing would let the state expire")
+var ErrInvalidDevice = errors.New("config: device name duplicate or not usable in topics")
+var ErrInvalidTimeout = errors.New("config: timeout not positive")
+var ErrInvalidMac = errors.New("config: device mac invalid or duplicate")
+var ErrInvalidDiscovery = errors.New("config: discovery samples negative")
+
+// gatewayNamePattern matches names usable as a single topic level and as the
+// node or object id of discovery topics, which gateway names may be part of.
+var gatewayNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// mqttPorts are the default broker ports of the supported schemes.
+var mqttPorts = map[string]uint16{
+	"tcp": 1883,
+	"ssl": 8883,
+	"ws":  80,
+	"wss": 443,
+}
+
 type Config struct {
-	Serial  SerialConfig   `yaml:"serial"`
-	Mqtt    MqttConfig     `yaml:"mqtt"`
-	Devices []DeviceConfig `yaml:"devices" default:"[]"`
+	Serial        SerialConfig                 `yaml:"serial"`
+	Gateways      []GatewayConfig              `yaml:"gateways" default:"[]"`
+	Deduplication DeduplicationConfig          `yaml:"deduplication"`
+	Availability  AvailabilityConfig           `yaml:"availability"`
+	State         StateConfig                  `yaml:"state"`
+	Discovery     DiscoveryConfig              `yaml:"discovery"`
+	Batteries     map[string]BatteryConfig     `yaml:"batteries"`
+	Publishing    map[string]PublishConfig     `yaml:"publishing"`
+	Aggregation   map[string]AggregationConfig `yaml:"aggregation"`
+	Mqtt          MqttConfig                   `yaml:"mqtt"`
+	HomeAssistant HomeAssistantConfig          `yaml:"homeassistant"`
+	Topics        TopicsConfig                 `yaml:"topics"`
+	Definitions   []string                     `yaml:"definitions" default:"[]"`
+	Devices       []DeviceConfig               `yaml:"devices" default:"[]"`
 }
 
 type SerialConfig struct {
-	Port     string `yaml:"port"`
-	BaudRate uint   `yaml:"baudrate" default:"115200"`
+	Port          string        `yaml:"port"`
+	BaudRate      uint          `yaml:"baudrate" default:"115200"`
+	Rssi          bool          `yaml:"rssi"`
+	Checksum      string        `yaml:"checksum" default:"none"`
+	MaxPayload    uint8         `yaml:"max_payload" default:"64"`
+	Timeouts      TimeoutConfig `yaml:"timeouts"`
+	TimeoutPolicy string        `yaml:"timeout_policy" default:"resync"`
+	MaxTimeouts   uint          `yaml:"max_timeouts" default:"3"`
+	MaxReconnects uint          `yaml:"max_reconnects"`
+	Diagnostics   time.Duration `yaml:"diagnostics_interval" default:"1m"`
+}
+
+type GatewayConfig struct {
+	Name         string `yaml:"name"`
+	SerialConfig `yaml:",inline"`
+}
+
+// UnmarshalYAML applies the defaults before decoding, so explicit zeros like
+// max_payload: 0 are kept.
+func (gateway *GatewayConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := defaults.Set(gateway); err != nil {
+		return err
+	}
+
+	type plain GatewayConfig
+	return unmarshal((*plain)(gateway))
+}
+
+type DeduplicationConfig struct {
+	Strategy string        `yaml:"strategy" default:"first"`
+	Window   time.Duration `yaml:"window" default:"2s"`
+}
+
+type TimeoutConfig struct {
+	Default      time.Duration `yaml:"default" default:"1s"`
+	Synchronize  time.Duration `yaml:"synchronize"`
+	MessageCount time.Duration `yaml:"message_count"`
+	Read         time.Duration `yaml:"read"`
+	ReadMac      time.Duration `yaml:"read_mac"`
+	ReadVersion  time.Duration `yaml:"read_version"`
+	Send         time.Duration `yaml:"send"`
+	Await        time.Duration `yaml:"await" default:"10s"`
 }
 
+// MqttConfig describes the broker connection. The port defaults to the one
+// of the scheme and the password may be read from a file or the environment.
 type MqttConfig struct {
-	Host string `yaml:"host" default:"localhost"`
-	Port uint16 `yaml:"port" default:"1883"`
+	Scheme       string        `yaml:"scheme" default:"tcp"`
+	Host         string        `yaml:"host" default:"localhost"`
+	Port         uint16        `yaml:"port"`
+	Path         string        `yaml:"path"`
+	ClientId     string        `yaml:"client_id"`
+	Keepalive    time.Duration `yaml:"keepalive" default:"30s"`
+	Username     string        `yaml:"username"`
+	Password     string        `yaml:"password"`
+	PasswordFile string        `yaml:"password_file"`
+	PasswordEnv  string        `yaml:"password_env"`
+	Tls          TlsConfig     `yaml:"tls"`
+}
+
+type TlsConfig struct {
+	Ca                 string `yaml:"ca"`
+	Cert               string `yaml:"cert"`
+	Key                string `yaml:"key"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// HomeAssistantConfig describes how to follow restarts of Home Assistant. On
+// its birth message everything retained is published again, after a random
+// delay of up to jitter. The status topic defaults to <discovery prefix>/status.
+type HomeAssistantConfig struct {
+	StatusTopic string        `yaml:"status_topic"`
+	Jitter      time.Duration `yaml:"jitter"`
+}
+
+// TopicsConfig holds text/template templates of the device topics. Empty ones
+// keep the default layout. The bridge's own topics live below base.
+type TopicsConfig struct {
+	Base            string `yaml:"base" default:"protons"`
+	DiscoveryPrefix string `yaml:"discovery_prefix" default:"homeassistant"`
+	State           string `yaml:"state"`
+	Availability    string `yaml:"availability"`
+	Command         string `yaml:"command"`
+	Discovery       string `yaml:"discovery"`
+}
+
+type AvailabilityConfig struct {
+	Timeout  time.Duration            `yaml:"timeout" default:"3m"`
+	Interval time.Duration            `yaml:"interval" default:"10s"`
+	Types    map[string]time.Duration `yaml:"types"`
+}
+
+type StateConfig struct {
+	Path  string        `yaml:"path" default:"state.json"`
+	Flush time.Duration `yaml:"flush_interval" default:"1m"`
+}
+
+type DiscoveryConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Samples int    `yaml:"samples" default:"3"`
+	Listen  string `yaml:"listen"`
 }
 
 type DeviceConfig struct {
-	Type string `yaml:"type"`
-	Mac  string `yaml:"mac"`
+	Type    string        `yaml:"type"`
+	Mac     string        `yaml:"mac"`
+	Name    string        `yaml:"name"`
+	Gateway string        `yaml:"gateway"`
+	Timeout time.Duration `yaml:"timeout"`
+	Script  string        `yaml:"script"`
+
+	Battery     *BatteryConfig               `yaml:"battery"`
+	Publish     *PublishConfig               `yaml:"publish"`
+	Aggregation *AggregationConfig           `yaml:"aggregation"`
+	Calibration map[string]CalibrationConfig `yaml:"calibration"`
+}
+
+// BatteryConfig selects how the battery level is derived from its voltage.
+// Low is the level in percent below which the battery is reported low, zero
+// disables the report.
+type BatteryConfig struct {
+	Profile string          `yaml:"profile"`
+	Points  []battery.Point `yaml:"points"`
+	Low     float64         `yaml:"low"`
+}
+
+// PublishConfig limits how often the state of a device is published. Changes
+// within the deadband of every field are skipped unless the heartbeat is due,
+// and no state is published sooner than min_interval after the previous one.
+type PublishConfig struct {
+	Deadband    map[string]float64 `yaml:"deadband"`
+	Heartbeat   time.Duration      `yaml:"heartbeat"`
+	MinInterval time.Duration      `yaml:"min_interval"`
+}
+
+// AggregationConfig enables rolling statistics of the state fields, all
+// numeric ones unless fields are listed, published every interval.
+type AggregationConfig struct {
+	Windows       []time.Duration `yaml:"windows"`
+	Fields        []string        `yaml:"fields"`
+	Interval      time.Duration   `yaml:"interval"`
+	HomeAssistant bool            `yaml:"homeassistant"`
+}
+
+// CalibrationConfig corrects a raw reading either by gain and offset or, when
+// two reference points are given, by the line through them.
+type CalibrationConfig struct {
+	Offset float64            `yaml:"offset"`
+	Gain   float64            `yaml:"gain"`
+	Points []CalibrationPoint `yaml:"points"`
+}
+
+type CalibrationPoint struct {
+	Raw    float64 `yaml:"raw"`
+	Actual float64 `yaml:"actual"`
 }
 
 func Load(reader io.Reader) (*Config, error) {
@@ -38,5 +223,255 @@ func Load(reader io.Reader) (*Config, error) {
 		return nil, err
 	}
 
+	// a single serial section is shorthand for one gateway named "default"
+	if len(config.Gateways) > 0 && config.Serial.Port != "" {
+		log.Warnf("both serial and gateways are configured, ignoring serial")
+	}
+	if len(config.Gateways) == 0 && config.Serial.Port != "" {
+		config.Gateways = append(config.Gateways, GatewayConfig{
+			Name:         DefaultGatewayName,
+			SerialConfig: config.Serial,
+		})
+	}
+
+	names := make(map[string]bool)
+	for _, gateway := range config.Gateways {
+		if !gatewayNamePattern.MatchString(gateway.Name) || names[gateway.Name] {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidGateway, gateway.Name)
+		}
+		names[gateway.Name] = true
+
+		if err := gateway.Timeouts.validate(); err != nil {
+			return nil, fmt.Errorf("%w: gateway %s", err, gateway.Name)
+		}
+	}
+
+	if config.Discovery.Samples < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidDiscovery, config.Discovery.Samples)
+	}
+
+	if config.HomeAssistant.StatusTopic == "" {
+		config.HomeAssistant.StatusTopic = config.Topics.DiscoveryPrefix + "/status"
+	}
+
+	port, found := mqttPorts[config.Mqtt.Scheme]
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownScheme, config.Mqtt.Scheme)
+	}
+	if config.Mqtt.Port == 0 {
+		config.Mqtt.Port = port
+	}
+
+	// adopted devices inherit the publishing of their type
+	for deviceType, publish := range config.Publishing {
+		if err := publish.validate(config.typeTimeout(deviceType)); err != nil {
+			return nil, fmt.Errorf("%w: type %s", err, deviceType)
+		}
+	}
+
+	if err := config.normalizeMacs(); err != nil {
+		return nil, err
+	}
+
+	for _, device := range config.Devices {
+		if err := config.CheckName(device); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, device := range config.Devices {
+		config.Inherit(&config.Devices[i])
+
+		for field, calibration := range device.Calibration {
+			if err := calibration.validate(); err != nil {
+				return nil, fmt.Errorf("%w: %s of %s", err, field, device.Mac)
+			}
+		}
+
+		inherited := config.Devices[i]
+		if inherited.Publish != nil {
+			if err := inherited.Publish.validate(inherited.Timeout); err != nil {
+				return nil, fmt.Errorf("%w: device %s", err, device.Mac)
+			}
+		}
+	}
+
 	return &config, nil
 }
+
+// CheckDeviceName fails for device names which cannot be part of topics.
+// Empty names are left to the device id.
+func CheckDeviceName(name string) error {
+	if strings.ContainsAny(name, "+#") {
+		return fmt.Errorf("%w: %q", ErrInvalidDevice, name)
+	}
+
+	return nil
+}
+
+// CheckName fails for the name of a device which cannot be part of topics or
+// which is taken by another configured device, as names may be part of the
+// topics of a device.
+func (config *Config) CheckName(device DeviceConfig) error {
+	if err := CheckDeviceName(device.Name); err != nil || device.Name == "" {
+		return err
+	}
+
+	for _, other := range config.Devices {
+		if other.Mac != device.Mac && other.Name == device.Name {
+			return fmt.Errorf("%w: %q", ErrInvalidDevice, device.Name)
+		}
+	}
+
+	return nil
+}
+
+// normalizeMacs brings the mac of every configured device into the form
+// packets report it in, so "01:23:45:67:89:AB" matches 0123456789ab, and
+// fails for two entries configuring the same device.
+func (config *Config) normalizeMacs() error {
+	entries := make(map[string]int)
+	for i := range config.Devices {
+		device := &config.Devices[i]
+
+		mac, err := utils.NormalizeMac(device.Mac)
+		if err != nil {
+			return fmt.Errorf("%w: %q of device %d", ErrInvalidMac, device.Mac, i+1)
+		}
+		device.Mac = mac
+
+		if first, found := entries[mac]; found {
+			return fmt.Errorf("%w: devices %d (%s) and %d (%s) both use %s", ErrInvalidMac,
+				first+1, config.Devices[first].describe(), i+1, device.describe(), mac)
+		}
+		entries[mac] = i
+	}
+
+	return nil
+}
+
+// describe names a device entry by its name, or by its type if unnamed.
+func (device DeviceConfig) describe() string {
+	if device.Name != "" {
+		return fmt.Sprintf("%q", device.Name)
+	}
+	return "type " + device.Type
+}
+
+// Broker returns the URL of the broker, e.g. ssl://broker:8883 or
+// wss://broker:443/mqtt.
+func (mqtt MqttConfig) Broker() string {
+	return fmt.Sprintf("%s://%s:%d%s", mqtt.Scheme, mqtt.Host, mqtt.Port, mqtt.Path)
+}
+
+// Secure reports whether the connection uses TLS.
+func (mqtt MqttConfig) Secure() bool {
+	return mqtt.Scheme == "ssl" || mqtt.Scheme == "wss"
+}
+
+// validate checks that a device with the given timeout keeps publishing its
+// state before Home Assistant expires it: a deadband needs a heartbeat below
+// the timeout, and min_interval must stay below it as well.
+func (publish PublishConfig) validate(timeout time.Duration) error {
+	if timeout == 0 {
+		return nil
+	}
+
+	if publish.MinInterval >= timeout {
+		return fmt.Errorf("%w: min_interval %s not below timeout %s", ErrInvalidPublishing, publish.MinInterval, timeout)
+	}
+	if len(publish.Deadband) > 0 && (publish.Heartbeat == 0 || publish.Heartbeat >= timeout) {
+		return fmt.Errorf("%w: deadband needs a heartbeat below timeout %s", ErrInvalidPublishing, timeout)
+	}
+
+	return nil
+}
+
+// validate checks that every command gets a deadline in the future. Zero
+// command timeouts take the default one, which must be positive.
+func (timeouts TimeoutConfig) validate() error {
+	if timeouts.Default <= 0 {
+		return fmt.Errorf("%w: default %s", ErrInvalidTimeout, timeouts.Default)
+	}
+
+	commands := map[string]time.Duration{
+		"synchronize":   timeouts.Synchronize,
+		"message_count": timeouts.MessageCount,
+		"read":          timeouts.Read,
+		"read_mac":      timeouts.ReadMac,
+		"read_version":  timeouts.ReadVersion,
+		"send":          timeouts.Send,
+		"await":         timeouts.Await,
+	}
+	for command, timeout := range commands {
+		if timeout < 0 {
+			return fmt.Errorf("%w: %s %s", ErrInvalidTimeout, command, timeout)
+		}
+	}
+
+	return nil
+}
+
+func (calibration CalibrationConfig) validate() error {
+	if len(calibration.Points) == 0 {
+		return nil
+	}
+
+	if len(calibration.Points) != 2 || calibration.Points[0].Raw == calibration.Points[1].Raw {
+		return ErrInvalidCalibration
+	}
+
+	return nil
+}
+
+// Apply returns the calibrated value of a raw reading. A gain of zero is
+// taken as unset.
+func (calibration CalibrationConfig) Apply(raw float64) float64 {
+	if len(calibration.Points) == 2 {
+		low, high := calibration.Points[0], calibration.Points[1]
+		gain := (high.Actual - low.Actual) / (high.Raw - low.Raw)
+		return low.Actual + (raw-low.Raw)*gain
+	}
+
+	gain := calibration.Gain
+	if gain == 0 {
+		gain = 1
+	}
+
+	return raw*gain + calibration.Offset
+}
+
+// typeTimeout returns the availability timeout of devices of a type which do
+// not configure their own.
+func (config *Config) typeTimeout(deviceType string) time.Duration {
+	if timeout, found := config.Availability.Types[deviceType]; found {
+		return timeout
+	}
+	return config.Availability.Timeout
+}
+
+// Inherit fills in the settings a device does not configure itself from the
+// ones configured for its type.
+func (config *Config) Inherit(device *DeviceConfig) {
+	if device.Timeout == 0 {
+		device.Timeout = config.typeTimeout(device.Type)
+	}
+
+	if device.Battery == nil {
+		if batteryConfig, found := config.Batteries[device.Type]; found {
+			device.Battery = &batteryConfig
+		}
+	}
+
+	if device.Publish == nil {
+		if publishConfig, found := config.Publishing[device.Type]; found {
+			device.Publish = &publishConfig
+		}
+	}
+
+	if device.Aggregation == nil {
+		if aggregationConfig, found := config.Aggregation[device.Type]; found {
+			device.Aggregation = &aggregationConfig
+		}
+	}
+}
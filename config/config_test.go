@@ -0,0 +1,100 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLoadNormalizesMacs(t *testing.T) {
+	tests := []struct {
+		name    string
+		macs    []string
+		want    []string
+		wantErr error
+	}{
+		{"lower case", []string{"0123456789ab"}, []string{"0123456789ab"}, nil},
+		{"upper case", []string{"0123456789AB"}, []string{"0123456789ab"}, nil},
+		{"colons", []string{"01:23:45:67:89:ab"}, []string{"0123456789ab"}, nil},
+		{"dashes", []string{"01-23-45-67-89-AB"}, []string{"0123456789ab"}, nil},
+		{"distinct", []string{"0123456789ab", "0123456789ac"}, []string{"0123456789ab", "0123456789ac"}, nil},
+		{"too short", []string{"0123456789"}, nil, ErrInvalidMac},
+		{"not hex", []string{"0123456789xy"}, nil, ErrInvalidMac},
+		{"empty", []string{""}, nil, ErrInvalidMac},
+		{"duplicate", []string{"0123456789ab", "0123456789ab"}, nil, ErrInvalidMac},
+		{"duplicate after normalizing", []string{"0123456789ab", "01:23:45:67:89:AB"}, nil, ErrInvalidMac},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			yaml := "devices:\n"
+			for _, mac := range test.macs {
+				yaml += "  - type: ht\n    mac: \"" + mac + "\"\n"
+			}
+
+			config, err := Load(strings.NewReader(yaml))
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Load() = %v, want %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			for i, device := range config.Devices {
+				if device.Mac != test.want[i] {
+					t.Errorf("device %d mac = %q, want %q", i+1, device.Mac, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLoadNamesDuplicateMacEntries(t *testing.T) {
+	yaml := `
+devices:
+  - type: ht
+    mac: "0123456789ab"
+    name: kitchen
+  - type: ht
+    mac: "0123456789ac"
+  - type: ht
+    mac: "01:23:45:67:89:AB"
+    name: attic
+`
+
+	_, err := Load(strings.NewReader(yaml))
+	if !errors.Is(err, ErrInvalidMac) {
+		t.Fatalf("Load() = %v, want %v", err, ErrInvalidMac)
+	}
+	for _, entry := range []string{`1 ("kitchen")`, `3 ("attic")`, "0123456789ab"} {
+		if !strings.Contains(err.Error(), entry) {
+			t.Errorf("Load() = %q, want it to name %s", err, entry)
+		}
+	}
+}
+
+func TestLoadDiscoverySamples(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		want    int
+		wantErr error
+	}{
+		{"default", "discovery:\n  enabled: true\n", 3, nil},
+		{"none", "discovery:\n  samples: 0\n", 0, nil},
+		{"some", "discovery:\n  samples: 10\n", 10, nil},
+		{"negative", "discovery:\n  samples: -1\n", 0, ErrInvalidDiscovery},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := Load(strings.NewReader(test.yaml))
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Load() = %v, want %v", err, test.wantErr)
+			}
+			if err == nil && config.Discovery.Samples != test.want {
+				t.Errorf("Discovery.Samples = %d, want %d", config.Discovery.Samples, test.want)
+			}
+		})
+	}
+}
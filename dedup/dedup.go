@@ -0,0 +1,200 @@
+package dedup
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"proton-gateway/packet"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Strategy decides which copy of a packet heard by several gateways is kept.
+type Strategy string
+
+const (
+	// StrategyFirst forwards the first copy right away and drops the rest.
+	StrategyFirst Strategy = "first"
+	// StrategyStrongest holds a packet for the window and forwards the copy
+	// received with the highest RSSI.
+	StrategyStrongest Strategy = "strongest"
+)
+
+var ErrUnknownStrategy = errors.New("dedup: unknown strategy")
+
+type pending struct {
+	key   string
+	best  packet.Packet
+	seen  time.Time
+	timer *time.Timer
+}
+
+// Deduplicator drops copies of the same transmission arriving through
+// different gateways within a time window.
+type Deduplicator struct {
+	strategy Strategy
+	window   time.Duration
+	emit     func(packet.Packet)
+	// clocked deduplicators hold packets until the time of a later packet
+	// instead of a timer
+	clocked bool
+
+	lock     sync.Mutex
+	entries  map[string]*pending
+	closed   bool
+	inFlight sync.WaitGroup
+}
+
+func New(strategy string, window time.Duration, emit func(packet.Packet)) (*Deduplicator, error) {
+	switch Strategy(strategy) {
+	case StrategyFirst, StrategyStrongest:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownStrategy, strategy)
+	}
+
+	return &Deduplicator{
+		strategy: Strategy(strategy),
+		window:   window,
+		emit:     emit,
+		entries:  make(map[string]*pending),
+	}, nil
+}
+
+// NewClocked creates a Deduplicator driven by the timestamps of the packets,
+// like those of a capture, instead of the wall clock. Packets held back by
+// the strongest strategy are emitted by the Add of the first packet after
+// their window, or by Close, on the calling goroutine and in the order they
+// were first heard.
+func NewClocked(strategy string, window time.Duration, emit func(packet.Packet)) (*Deduplicator, error) {
+	d, err := New(strategy, window, emit)
+	if err != nil {
+		return nil, err
+	}
+
+	d.clocked = true
+	return d, nil
+}
+
+func (d *Deduplicator) Add(p packet.Packet) {
+	key := p.Mac() + "/" + hex.EncodeToString(p.Payload())
+
+	d.lock.Lock()
+	if d.closed {
+		d.lock.Unlock()
+		return
+	}
+	d.expire(p.Timestamp())
+
+	if d.clocked {
+		due := d.due(p.Timestamp())
+		d.lock.Unlock()
+		for _, held := range due {
+			d.emit(held)
+		}
+		d.lock.Lock()
+	}
+
+	entry, found := d.entries[key]
+	if found {
+		if d.strategy == StrategyStrongest && p.Rssi() > entry.best.Rssi() {
+			entry.best = p
+		}
+		d.lock.Unlock()
+		return
+	}
+
+	entry = &pending{key: key, best: p, seen: p.Timestamp()}
+	d.entries[key] = entry
+	if d.strategy == StrategyFirst {
+		d.lock.Unlock()
+		d.emit(p)
+		return
+	}
+
+	if d.clocked {
+		d.lock.Unlock()
+		return
+	}
+
+	d.inFlight.Add(1)
+	entry.timer = time.AfterFunc(d.window, func() {
+		defer d.inFlight.Done()
+
+		d.lock.Lock()
+		best := entry.best
+		delete(d.entries, key)
+		d.lock.Unlock()
+
+		d.emit(best)
+	})
+	d.lock.Unlock()
+}
+
+// Close forwards every packet still held back and stops accepting new ones.
+func (d *Deduplicator) Close() {
+	d.lock.Lock()
+	d.closed = true
+	var held []*pending
+	for key, entry := range d.entries {
+		if entry.timer != nil && entry.timer.Stop() {
+			held = append(held, entry)
+			d.inFlight.Done()
+		} else if d.clocked && d.strategy == StrategyStrongest {
+			held = append(held, entry)
+		}
+		delete(d.entries, key)
+	}
+	d.lock.Unlock()
+
+	for _, p := range bySeen(held) {
+		d.emit(p)
+	}
+	d.inFlight.Wait()
+}
+
+// due removes the packets held back by a clocked deduplicator whose window
+// has passed at now and returns them in the order they were first heard.
+func (d *Deduplicator) due(now time.Time) []packet.Packet {
+	if d.strategy != StrategyStrongest {
+		return nil
+	}
+
+	var due []*pending
+	for key, entry := range d.entries {
+		if now.Sub(entry.seen) >= d.window {
+			due = append(due, entry)
+			delete(d.entries, key)
+		}
+	}
+
+	return bySeen(due)
+}
+
+func bySeen(entries []*pending) []packet.Packet {
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].seen.Equal(entries[j].seen) {
+			return entries[i].seen.Before(entries[j].seen)
+		}
+		return entries[i].key < entries[j].key
+	})
+
+	packets := make([]packet.Packet, len(entries))
+	for i, entry := range entries {
+		packets[i] = entry.best
+	}
+
+	return packets
+}
+
+func (d *Deduplicator) expire(now time.Time) {
+	if d.strategy != StrategyFirst {
+		return
+	}
+
+	for key, entry := range d.entries {
+		if now.Sub(entry.seen) >= d.window {
+			delete(d.entries, key)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package dedup
+
+import (
+	"fmt"
+	"proton-gateway/packet"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder collects emitted packets, which the strongest strategy emits from
+// timers.
+type recorder struct {
+	lock    sync.Mutex
+	packets []packet.Packet
+}
+
+func (r *recorder) emit(p packet.Packet) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.packets = append(r.packets, p)
+}
+
+func (r *recorder) emitted() []packet.Packet {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]packet.Packet(nil), r.packets...)
+}
+
+var start = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func heard(mac string, payload byte, gateway string, rssi int8, after time.Duration) packet.Packet {
+	return packet.New(mac, start.Add(after), []byte{payload}, gateway, rssi)
+}
+
+func TestNewRejectsUnknownStrategy(t *testing.T) {
+	if _, err := New("loudest", time.Second, func(packet.Packet) {}); err == nil {
+		t.Errorf("New() accepted an unknown strategy")
+	}
+}
+
+func TestFirst(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets []packet.Packet
+		want    []string
+	}{
+		{"copies dropped", []packet.Packet{
+			heard("0123456789ab", 1, "a", -80, 0),
+			heard("0123456789ab", 1, "b", -40, 100*time.Millisecond),
+		}, []string{"a"}},
+		{"other payload kept", []packet.Packet{
+			heard("0123456789ab", 1, "a", -80, 0),
+			heard("0123456789ab", 2, "b", -40, 100*time.Millisecond),
+		}, []string{"a", "b"}},
+		{"other device kept", []packet.Packet{
+			heard("0123456789ab", 1, "a", -80, 0),
+			heard("ba9876543210", 1, "b", -40, 100*time.Millisecond),
+		}, []string{"a", "b"}},
+		{"repeat after window kept", []packet.Packet{
+			heard("0123456789ab", 1, "a", -80, 0),
+			heard("0123456789ab", 1, "b", -40, time.Second),
+			heard("0123456789ab", 1, "a", -80, 2*time.Second),
+		}, []string{"a", "a"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &recorder{}
+			d, err := New(string(StrategyFirst), 2*time.Second, r.emit)
+			if err != nil {
+				t.Fatalf("New() = %v", err)
+			}
+
+			for _, p := range test.packets {
+				d.Add(p)
+			}
+			d.Close()
+
+			emitted := r.emitted()
+			if len(emitted) != len(test.want) {
+				t.Fatalf("%d packets emitted, want %d", len(emitted), len(test.want))
+			}
+			for i, p := range emitted {
+				if p.Gateway() != test.want[i] {
+					t.Errorf("packet %d from gateway %s, want %s", i, p.Gateway(), test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestStrongestEmitsBestCopyAfterWindow(t *testing.T) {
+	r := &recorder{}
+	d, err := New(string(StrategyStrongest), 20*time.Millisecond, r.emit)
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	defer d.Close()
+
+	d.Add(heard("0123456789ab", 1, "a", -80, 0))
+	d.Add(heard("0123456789ab", 1, "b", -40, 0))
+	d.Add(heard("0123456789ab", 1, "c", -60, 0))
+	if emitted := r.emitted(); len(emitted) != 0 {
+		t.Fatalf("%d packets emitted within the window, want 0", len(emitted))
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(r.emitted()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	emitted := r.emitted()
+	if len(emitted) != 1 || emitted[0].Gateway() != "b" {
+		t.Errorf("emitted %v, want the copy of gateway b", emitted)
+	}
+}
+
+func TestStrongestCloseEmitsHeldPackets(t *testing.T) {
+	r := &recorder{}
+	d, err := New(string(StrategyStrongest), time.Hour, r.emit)
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+
+	d.Add(heard("0123456789ab", 1, "a", -80, 0))
+	d.Add(heard("0123456789ab", 1, "b", -40, 0))
+	d.Add(heard("ba9876543210", 1, "a", -70, 0))
+	d.Close()
+	d.Add(heard("ba9876543210", 2, "a", -70, 0))
+
+	if emitted := r.emitted(); len(emitted) != 2 {
+		t.Errorf("%d packets emitted by Close, want 2", len(emitted))
+	}
+}
+
+func TestConcurrentGateways(t *testing.T) {
+	for _, strategy := range []Strategy{StrategyFirst, StrategyStrongest} {
+		t.Run(string(strategy), func(t *testing.T) {
+			r := &recorder{}
+			d, err := New(string(strategy), time.Hour, r.emit)
+			if err != nil {
+				t.Fatalf("New() = %v", err)
+			}
+
+			wg := sync.WaitGroup{}
+			for gateway := 0; gateway < 8; gateway++ {
+				wg.Add(1)
+				go func(gateway int) {
+					defer wg.Done()
+					for payload := 0; payload < 50; payload++ {
+						d.Add(heard("0123456789ab", byte(payload), string(rune('a'+gateway)), int8(-gateway), 0))
+					}
+				}(gateway)
+			}
+			wg.Wait()
+			d.Close()
+
+			emitted := r.emitted()
+			if len(emitted) != 50 {
+				t.Errorf("%d packets emitted, want one per payload", len(emitted))
+			}
+			for _, p := range emitted {
+				if strategy == StrategyStrongest && p.Gateway() != "a" {
+					t.Errorf("emitted copy of gateway %s, want the strongest of gateway a", p.Gateway())
+				}
+			}
+		})
+	}
+}
+
+func TestClockedStrongestFollowsPacketTime(t *testing.T) {
+	r := &recorder{}
+	d, err := NewClocked(string(StrategyStrongest), 2*time.Second, r.emit)
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+
+	d.Add(heard("ba9876543210", 1, "a", -80, 0))
+	d.Add(heard("0123456789ab", 1, "a", -80, 0))
+	d.Add(heard("0123456789ab", 1, "b", -40, 500*time.Millisecond))
+	d.Add(heard("0123456789ab", 2, "a", -70, time.Second))
+	if emitted := r.emitted(); len(emitted) != 0 {
+		t.Fatalf("%d packets emitted within the window, want 0", len(emitted))
+	}
+
+	// the window of the first two packets has passed by the time of this one
+	d.Add(heard("0123456789ab", 3, "a", -70, 2*time.Second))
+	d.Close()
+
+	want := []string{"0123456789ab/1/b", "ba9876543210/1/a", "0123456789ab/2/a", "0123456789ab/3/a"}
+	emitted := r.emitted()
+	if len(emitted) != len(want) {
+		t.Fatalf("%d packets emitted, want %d", len(emitted), len(want))
+	}
+	for i, p := range emitted {
+		if got := fmt.Sprintf("%s/%d/%s", p.Mac(), p.Payload()[0], p.Gateway()); got != want[i] {
+			t.Errorf("packet %d is %s, want %s", i, got, want[i])
+		}
+	}
+}
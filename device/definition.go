@@ -0,0 +1,545 @@
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/creasty/defaults"
+	"gopkg.in/yaml.v2"
+	"io"
+	"math"
+	"proton-gateway/battery"
+	"proton-gateway/config"
+	"proton-gateway/homeassistant"
+	"proton-gateway/message"
+	"proton-gateway/packet"
+	"proton-gateway/store"
+	"proton-gateway/topic"
+	"strings"
+)
+
+// Definition describes a sensor type declaratively: which values are decoded
+// from which bytes of the payload, which values are derived from those, and
+// how all of them are announced to Home Assistant.
+type Definition struct {
+	Type            string              `yaml:"type"`
+	IdPrefix        string              `yaml:"id_prefix"`
+	Manufacturer    string              `yaml:"manufacturer"`
+	Model           string              `yaml:"model"`
+	SoftwareVersion string              `yaml:"sw_version"`
+	Fields          []FieldDefinition   `yaml:"fields" default:"[]"`
+	Derived         []DerivedDefinition `yaml:"derived" default:"[]"`
+
+	length int
+}
+
+// EntityDefinition holds what is common to decoded and derived values. The
+// published value is value * scale + value_offset.
+type EntityDefinition struct {
+	Name           string  `yaml:"name"`
+	Title          string  `yaml:"title"`
+	Unit           string  `yaml:"unit"`
+	DeviceClass    string  `yaml:"device_class"`
+	StateClass     string  `yaml:"state_class"`
+	EntityCategory string  `yaml:"entity_category"`
+	Precision      *int    `yaml:"precision"`
+	Scale          float64 `yaml:"scale" default:"1"`
+	ValueOffset    float64 `yaml:"value_offset"`
+	Hidden         bool    `yaml:"hidden"`
+}
+
+type FieldDefinition struct {
+	EntityDefinition `yaml:",inline"`
+	Offset           int    `yaml:"offset"`
+	Type             string `yaml:"type"`
+}
+
+type DerivedDefinition struct {
+	EntityDefinition `yaml:",inline"`
+	Function         string   `yaml:"function"`
+	Inputs           []string `yaml:"inputs" default:"[]"`
+}
+
+// UnmarshalYAML applies the defaults before decoding, so an explicit scale: 0
+// is kept.
+func (field *FieldDefinition) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := defaults.Set(field); err != nil {
+		return err
+	}
+
+	type plain FieldDefinition
+	return unmarshal((*plain)(field))
+}
+
+func (derived *DerivedDefinition) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := defaults.Set(derived); err != nil {
+		return err
+	}
+
+	type plain DerivedDefinition
+	return unmarshal((*plain)(derived))
+}
+
+type fieldType struct {
+	size   int
+	decode func(data []byte) float64
+}
+
+var fieldTypes = map[string]fieldType{
+	"uint8": {1, func(data []byte) float64 { return float64(data[0]) }},
+	"int8":  {1, func(data []byte) float64 { return float64(int8(data[0])) }},
+	"uint16le": {2, func(data []byte) float64 {
+		return float64(binary.LittleEndian.Uint16(data))
+	}},
+	"uint16be": {2, func(data []byte) float64 {
+		return float64(binary.BigEndian.Uint16(data))
+	}},
+	"int16le": {2, func(data []byte) float64 {
+		return float64(int16(binary.LittleEndian.Uint16(data)))
+	}},
+	"int16be": {2, func(data []byte) float64 {
+		return float64(int16(binary.BigEndian.Uint16(data)))
+	}},
+	"uint32le": {4, func(data []byte) float64 {
+		return float64(binary.LittleEndian.Uint32(data))
+	}},
+	"uint32be": {4, func(data []byte) float64 {
+		return float64(binary.BigEndian.Uint32(data))
+	}},
+	"int32le": {4, func(data []byte) float64 {
+		return float64(int32(binary.LittleEndian.Uint32(data)))
+	}},
+	"int32be": {4, func(data []byte) float64 {
+		return float64(int32(binary.BigEndian.Uint32(data)))
+	}},
+	"float32le": {4, func(data []byte) float64 {
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(data)))
+	}},
+	"float32be": {4, func(data []byte) float64 {
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	}},
+	"float64le": {8, func(data []byte) float64 {
+		return math.Float64frombits(binary.LittleEndian.Uint64(data))
+	}},
+	"float64be": {8, func(data []byte) float64 {
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	}},
+}
+
+type function struct {
+	inputs int
+	apply  func(inputs []float64) float64
+}
+
+// batteryFunction derives the battery level from its voltage. Defined devices
+// use their configured profile, scripts the linear one.
+const batteryFunction = "battery"
+
+var linearBattery, _ = battery.Lookup(battery.ProfileLinear, nil)
+
+var functions = map[string]function{
+	"value": {1, func(inputs []float64) float64 {
+		return inputs[0]
+	}},
+	batteryFunction: {1, func(inputs []float64) float64 {
+		return linearBattery.Level(inputs[0])
+	}},
+	"dew_point": {2, func(inputs []float64) float64 {
+		return dewPoint(inputs[0], inputs[1])
+	}},
+	"absolute_humidity": {2, func(inputs []float64) float64 {
+		return absoluteHumidity(inputs[0], inputs[1])
+	}},
+}
+
+var ErrInvalidDefinition = errors.New("device: invalid definition")
+
+func LoadDefinition(reader io.Reader) (*Definition, error) {
+	def := Definition{}
+
+	if err := defaults.Set(&def); err != nil {
+		return nil, err
+	}
+
+	if err := yaml.NewDecoder(reader).Decode(&def); err != nil {
+		return nil, err
+	}
+
+	if def.IdPrefix == "" {
+		def.IdPrefix = fmt.Sprintf("proton%s", def.Type)
+	}
+
+	if err := def.validate(); err != nil {
+		return nil, err
+	}
+
+	return &def, nil
+}
+
+func (def *Definition) validate() error {
+	if def.Type == "" {
+		return fmt.Errorf("%w: missing type", ErrInvalidDefinition)
+	}
+
+	known := make(map[string]bool)
+	for _, field := range def.Fields {
+		if field.Name == "" || known[field.Name] {
+			return fmt.Errorf("%w: missing or duplicate name %q", ErrInvalidDefinition, field.Name)
+		}
+		known[field.Name] = true
+
+		ft, found := fieldTypes[field.Type]
+		if !found {
+			return fmt.Errorf("%w: unknown type %q of field %s", ErrInvalidDefinition, field.Type, field.Name)
+		}
+		if field.Offset < 0 {
+			return fmt.Errorf("%w: negative offset of field %s", ErrInvalidDefinition, field.Name)
+		}
+
+		if end := field.Offset + ft.size; end > def.length {
+			def.length = end
+		}
+	}
+
+	for _, derived := range def.Derived {
+		if derived.Name == "" || known[derived.Name] {
+			return fmt.Errorf("%w: missing or duplicate name %q", ErrInvalidDefinition, derived.Name)
+		}
+
+		fn, found := functions[derived.Function]
+		if !found {
+			return fmt.Errorf("%w: unknown function %q of %s", ErrInvalidDefinition, derived.Function, derived.Name)
+		}
+		if len(derived.Inputs) != fn.inputs {
+			return fmt.Errorf("%w: %s takes %d inputs", ErrInvalidDefinition, derived.Function, fn.inputs)
+		}
+		for _, input := range derived.Inputs {
+			if !known[input] {
+				return fmt.Errorf("%w: unknown input %q of %s", ErrInvalidDefinition, input, derived.Name)
+			}
+		}
+
+		known[derived.Name] = true
+	}
+
+	return nil
+}
+
+// RegisterDefinition makes the definition available as a device type. A
+// definition replaces a built-in type of the same name. Payloads exactly as
+// long as the fields require are guessed to be of this type.
+func RegisterDefinition(def *Definition) {
+	RegisterDeviceFactory(def.Type, func(conf config.DeviceConfig, layout *topic.Layout) Device {
+		return &DefinedDevice{
+			def:     def,
+			conf:    conf,
+			layout:  layout,
+			battery: linearBattery,
+		}
+	})
+	RegisterSignature(def.Type, func(payload []byte) bool {
+		return len(payload) == def.length
+	})
+}
+
+type DefinedDevice struct {
+	def       *Definition
+	conf      config.DeviceConfig
+	layout    *topic.Layout
+	viaDevice string
+	state     store.Store
+	last      map[string]interface{}
+	battery   battery.Profile
+	low       float64
+}
+
+// Start selects the battery profile used by the battery function.
+func (dev *DefinedDevice) Start() error {
+	profile, low, err := batteryOf(dev.conf)
+	if err != nil {
+		return err
+	}
+	dev.battery, dev.low = profile, low
+
+	return nil
+}
+
+// function returns a derived function, the battery level following the
+// profile of the device.
+func (dev *DefinedDevice) function(name string) function {
+	if name == batteryFunction {
+		return function{1, func(inputs []float64) float64 {
+			return dev.battery.Level(inputs[0])
+		}}
+	}
+
+	return functions[name]
+}
+
+// batteryLevel returns the name of the value holding the battery level, if
+// the definition derives one.
+func (dev *DefinedDevice) batteryLevel() (string, bool) {
+	for _, derived := range dev.def.Derived {
+		if derived.Function == batteryFunction {
+			return derived.Name, true
+		}
+	}
+
+	return "", false
+}
+
+func (dev *DefinedDevice) Id() string {
+	return fmt.Sprintf("%s-%s", dev.def.IdPrefix, dev.conf.Mac)
+}
+
+func (dev *DefinedDevice) deviceConfig() *homeassistant.DeviceConfig {
+	conf := homeassistant.NewDeviceConfig()
+	conf.AddIdentifier(dev.Id())
+	if dev.def.Manufacturer != "" {
+		conf.SetManufacturer(dev.def.Manufacturer)
+	}
+	if dev.def.Model != "" {
+		conf.SetModel(dev.def.Model)
+	}
+	conf.SetName(dev.Id())
+	if dev.conf.Name != "" {
+		conf.SetName(dev.conf.Name)
+	}
+	if dev.def.SoftwareVersion != "" {
+		conf.SetSoftwareVersion(dev.def.SoftwareVersion)
+	}
+	if dev.viaDevice != "" {
+		conf.SetViaDevice(dev.viaDevice)
+	}
+
+	return conf
+}
+
+func (dev *DefinedDevice) baseConfig(name string) *homeassistant.EntityConfig {
+	base := homeassistant.NewEntityConfig()
+	base.AddAvailability(homeassistant.BridgeStatusTopic(dev.layout), "online", "offline")
+	base.AddAvailability(dev.availabilityTopic(), "online", "offline")
+	base.SetAvailabilityMode(homeassistant.AvailabilityModeAll)
+	base.SetObjectId(fmt.Sprintf("%s_%s", dev.Id(), name))
+	base.SetUniqueId(fmt.Sprintf("%s_%s", dev.Id(), name))
+	base.Device = dev.deviceConfig()
+
+	return base
+}
+
+func (dev *DefinedDevice) entityConfig(entity EntityDefinition) message.Message {
+	conf := homeassistant.NewSensorConfig(dev.baseConfig(entity.Name))
+	if dev.conf.Timeout > 0 {
+		conf.SetExpireAfter(int(dev.conf.Timeout.Seconds()))
+	}
+
+	if entity.DeviceClass != "" {
+		conf.SetDeviceClass(entity.DeviceClass)
+	}
+	if entity.StateClass != "" {
+		conf.SetStateClass(entity.StateClass)
+	}
+	if entity.Unit != "" {
+		conf.SetUnitOfMeasurement(entity.Unit)
+	}
+	if entity.EntityCategory != "" {
+		conf.SetEntityCategory(entity.EntityCategory)
+	}
+
+	template := fmt.Sprintf("{{ value_json.%s }}", entity.Name)
+	if entity.Precision != nil {
+		template = fmt.Sprintf("{{ value_json.%s | round(%d) }}", entity.Name, *entity.Precision)
+	}
+	conf.SetValueTemplate(template)
+
+	title := entity.Title
+	if title == "" {
+		title = titleOf(entity.Name)
+	}
+	conf.SetName(title)
+	conf.SetStateTopic(dev.StateTopic())
+
+	msg, err := message.Json(
+		homeassistant.AutoDiscoveryTopic(dev.layout, homeassistant.EntityTypeSensor, dev.topicDevice(), entity.Name),
+		conf,
+		true,
+		0,
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	return msg
+}
+
+func (dev *DefinedDevice) batteryLowConfig() message.Message {
+	conf := homeassistant.NewBinarySensorConfig(dev.baseConfig("battery_low"))
+	if dev.conf.Timeout > 0 {
+		conf.SetExpireAfter(int(dev.conf.Timeout.Seconds()))
+	}
+
+	conf.SetDeviceClass("battery")
+	conf.SetValueTemplate("{{ 'ON' if value_json.battery_low else 'OFF' }}")
+	conf.SetName("Battery Low")
+	conf.SetEntityCategory("diagnostic")
+	conf.SetStateTopic(dev.StateTopic())
+
+	msg, err := message.Json(
+		homeassistant.AutoDiscoveryTopic(dev.layout, homeassistant.EntityTypeBinarySensor, dev.topicDevice(), "battery_low"),
+		conf,
+		true,
+		0,
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	return msg
+}
+
+func (dev *DefinedDevice) Configuration(viaDevice string) []message.Message {
+	dev.viaDevice = viaDevice
+
+	var messages []message.Message
+	for _, field := range dev.def.Fields {
+		if !field.Hidden {
+			messages = append(messages, dev.entityConfig(field.EntityDefinition))
+		}
+	}
+	for _, derived := range dev.def.Derived {
+		if !derived.Hidden {
+			messages = append(messages, dev.entityConfig(derived.EntityDefinition))
+		}
+	}
+	if _, found := dev.batteryLevel(); found && dev.low > 0 {
+		messages = append(messages, dev.batteryLowConfig())
+	}
+
+	return messages
+}
+
+func (dev *DefinedDevice) Process(packet packet.Packet) []message.Message {
+	payload := packet.Payload()
+	if len(payload) < dev.def.length {
+		return dev.Offline()
+	}
+
+	values := make(map[string]float64)
+	for _, field := range dev.def.Fields {
+		ft := fieldTypes[field.Type]
+		raw := ft.decode(payload[field.Offset : field.Offset+ft.size])
+		value := raw*field.Scale + field.ValueOffset
+		if calibration, found := dev.conf.Calibration[field.Name]; found {
+			value = calibration.Apply(value)
+		}
+		values[field.Name] = value
+	}
+
+	for _, derived := range dev.def.Derived {
+		inputs := make([]float64, len(derived.Inputs))
+		for i, input := range derived.Inputs {
+			inputs[i] = values[input]
+		}
+
+		value := dev.function(derived.Function).apply(inputs)
+		values[derived.Name] = value*derived.Scale + derived.ValueOffset
+	}
+
+	published := make(map[string]interface{})
+	for name, value := range values {
+		if finite(value) {
+			published[name] = value
+		}
+	}
+	// an unknown level tells nothing about the battery being low
+	if level, found := dev.batteryLevel(); found && dev.low > 0 && finite(values[level]) {
+		published["battery_low"] = values[level] < dev.low
+	}
+
+	stateMessage, err := message.Json(dev.StateTopic(), published, false, 0)
+	if err != nil {
+		return dev.Offline()
+	}
+	dev.remember(published)
+
+	return []message.Message{
+		message.NewMessage(dev.availabilityTopic(), []byte("online"), true, 0),
+		stateMessage,
+	}
+}
+
+func (dev *DefinedDevice) Restore(state store.Store) error {
+	dev.state = state
+
+	var last map[string]interface{}
+	found, err := state.Get(dev.stateKey(), &last)
+	if err != nil {
+		return err
+	}
+	if found {
+		dev.last = last
+	}
+
+	return nil
+}
+
+func (dev *DefinedDevice) LastState() []message.Message {
+	if dev.last == nil {
+		return nil
+	}
+
+	stateMessage, err := message.Json(dev.StateTopic(), dev.last, false, 0)
+	if err != nil {
+		return nil
+	}
+
+	return []message.Message{stateMessage}
+}
+
+// remember keeps the published state, in the store as well once restored.
+func (dev *DefinedDevice) remember(published map[string]interface{}) {
+	dev.last = published
+	if dev.state != nil {
+		_ = dev.state.Set(dev.stateKey(), published)
+	}
+}
+
+func (dev *DefinedDevice) Offline() []message.Message {
+	return []message.Message{
+		message.NewMessage(dev.availabilityTopic(), []byte("offline"), true, 0),
+	}
+}
+
+func (dev *DefinedDevice) stateKey() string {
+	return fmt.Sprintf("%s/state", dev.Id())
+}
+
+func (dev *DefinedDevice) StateTopic() string {
+	return dev.layout.State(dev.topicDevice())
+}
+
+func (dev *DefinedDevice) availabilityTopic() string {
+	return dev.layout.Availability(dev.topicDevice())
+}
+
+func (dev *DefinedDevice) topicDevice() topic.Device {
+	return topic.NewDevice(dev.conf, dev.Id())
+}
+
+// titleOf turns a field name like battery_voltage into "Battery Voltage".
+func titleOf(name string) string {
+	words := strings.Split(name, "_")
+	for i, word := range words {
+		if word != "" {
+			words[i] = strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+
+	return strings.Join(words, " ")
+}
+
+// finite tells whether a value can be published, as JSON has no
+// representation for NaN and infinities.
+func finite(value float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0)
+}
@@ -0,0 +1,119 @@
+package device
+
+import (
+	"proton-gateway/config"
+	"proton-gateway/packet"
+	"proton-gateway/store"
+	"proton-gateway/topic"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDefinition = `
+type: level
+fields:
+  - name: level
+    type: uint8
+`
+
+func defaultLayout(t *testing.T) *topic.Layout {
+	layout, err := topic.NewLayout(config.TopicsConfig{})
+	if err != nil {
+		t.Fatalf("topic.NewLayout() = %v", err)
+	}
+
+	return layout
+}
+
+func newTestDefinedDevice(t *testing.T) *DefinedDevice {
+	def, err := LoadDefinition(strings.NewReader(testDefinition))
+	if err != nil {
+		t.Fatalf("LoadDefinition() = %v", err)
+	}
+
+	return &DefinedDevice{
+		def:     def,
+		conf:    config.DeviceConfig{Type: "level", Mac: "0123456789ab"},
+		layout:  defaultLayout(t),
+		battery: linearBattery,
+	}
+}
+
+func TestDefinedDeviceRemembersState(t *testing.T) {
+	state, err := store.Open("")
+	if err != nil {
+		t.Fatalf("Open() = %v", err)
+	}
+
+	dev := newTestDefinedDevice(t)
+	if err := dev.Restore(state); err != nil {
+		t.Fatalf("Restore() = %v", err)
+	}
+	if last := dev.LastState(); last != nil {
+		t.Errorf("LastState() before the first packet = %v, want none", last)
+	}
+	dev.Process(packet.New("0123456789ab", time.Now(), []byte{42}, "default", packet.RssiUnknown))
+
+	restarted := newTestDefinedDevice(t)
+	if err := restarted.Restore(state); err != nil {
+		t.Fatalf("Restore() = %v", err)
+	}
+
+	last := restarted.LastState()
+	if len(last) != 1 {
+		t.Fatalf("LastState() = %d messages, want 1", len(last))
+	}
+	if last[0].Topic() != dev.StateTopic() {
+		t.Errorf("LastState() topic = %q, want %q", last[0].Topic(), dev.StateTopic())
+	}
+	if payload := string(last[0].Payload()); payload != `{"level":42}` {
+		t.Errorf("LastState() payload = %s, want {\"level\":42}", payload)
+	}
+}
+
+// TestDefinedDeviceOmitsUnknownBatteryLevel checks that a voltage which is not
+// a number publishes neither a level nor a low battery.
+func TestDefinedDeviceOmitsUnknownBatteryLevel(t *testing.T) {
+	def, err := LoadDefinition(strings.NewReader(`
+type: cell
+fields:
+  - name: battery_voltage
+    type: float32le
+derived:
+  - name: battery_level
+    function: battery
+    inputs: [battery_voltage]
+`))
+	if err != nil {
+		t.Fatalf("LoadDefinition() = %v", err)
+	}
+	dev := &DefinedDevice{
+		def:     def,
+		conf:    config.DeviceConfig{Type: "cell", Mac: "0123456789ab"},
+		layout:  defaultLayout(t),
+		battery: linearBattery,
+		low:     20,
+	}
+
+	tests := []struct {
+		name    string
+		payload []byte
+		want    string
+	}{
+		{"known", []byte{0x00, 0x00, 0x40, 0x40}, `{"battery_level":0,"battery_low":true,"battery_voltage":3}`},
+		{"not a number", []byte{0x00, 0x00, 0xc0, 0x7f}, `{}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messages := dev.Process(packet.New("0123456789ab", time.Now(), test.payload, "default", packet.RssiUnknown))
+			if len(messages) != 2 {
+				t.Fatalf("Process() = %d messages, want 2", len(messages))
+			}
+			if payload := string(messages[1].Payload()); payload != test.want {
+				t.Errorf("Process() state = %s, want %s", payload, test.want)
+			}
+		})
+	}
+}
@@ -1,27 +1,114 @@
 package device
 
 import (
+	"errors"
+	"proton-gateway/config"
 	"proton-gateway/message"
 	"proton-gateway/packet"
+	"proton-gateway/store"
+	"proton-gateway/topic"
+	"sort"
 )
 
+// Device translates packets of a single sensor into MQTT messages. Every
+// configured MAC gets its own instance, created by the factory registered for
+// its type. The viaDevice passed to Configuration is the Home Assistant id of
+// the gateway the sensor is reached through. Process publishes the decoded
+// values as a JSON object to StateTopic.
 type Device interface {
-	Configuration(mac string) []message.Message
+	Configuration(viaDevice string) []message.Message
 	Process(packet packet.Packet) []message.Message
+	Offline() []message.Message
+	StateTopic() string
+	Id() string
 }
 
-var devices map[string]Device
+// Commander is implemented by devices accepting commands from MQTT. Command
+// translates a payload received on CommandTopic into a frame for the device.
+type Commander interface {
+	CommandTopic() string
+	Command(payload []byte) ([]byte, error)
+}
+
+// Starter is implemented by devices which need to set up before their first
+// packet is processed.
+type Starter interface {
+	Start() error
+}
+
+// Stopper is implemented by devices which need to clean up after their last
+// packet was processed.
+type Stopper interface {
+	Stop() error
+}
+
+// Stateful is implemented by devices keeping state across restarts. Restore
+// hands over the shared store before the device is started; keys should be
+// prefixed with the device id.
+type Stateful interface {
+	Restore(state store.Store) error
+}
+
+// Remembering is implemented by devices which restore their last state.
+// LastState returns the state messages published before the restart, if any.
+type Remembering interface {
+	LastState() []message.Message
+}
+
+// Factory creates the device instance for one configured sensor, publishing
+// to the topics of layout.
+type Factory func(conf config.DeviceConfig, layout *topic.Layout) Device
 
-func RegisterDevice(deviceType string, device Device) {
-	devices[deviceType] = device
+var ErrUnknownType = errors.New("device: unknown device type")
+var ErrInvalidCommand = errors.New("device: invalid command")
+
+// Signature tells whether a payload looks like it was sent by a device type.
+type Signature func(payload []byte) bool
+
+var factories map[string]Factory
+var signatures map[string]Signature
+
+func RegisterDeviceFactory(deviceType string, factory Factory) {
+	factories[deviceType] = factory
+}
+
+func RegisterSignature(deviceType string, signature Signature) {
+	signatures[deviceType] = signature
 }
 
-func GetDeviceByType(deviceType string) Device {
-	device, _ := devices[deviceType]
-	return device
+// GuessType returns the first device type, in alphabetical order, whose
+// signature matches the payload, or an empty string.
+func GuessType(payload []byte) string {
+	types := make([]string, 0, len(signatures))
+	for deviceType := range signatures {
+		types = append(types, deviceType)
+	}
+	sort.Strings(types)
+
+	for _, deviceType := range types {
+		if signatures[deviceType](payload) {
+			return deviceType
+		}
+	}
+
+	return ""
+}
+
+func NewDevice(conf config.DeviceConfig, layout *topic.Layout) (Device, error) {
+	factory, found := factories[conf.Type]
+	if !found {
+		return nil, ErrUnknownType
+	}
+
+	return factory(conf, layout), nil
 }
 
 func init() {
-	devices = make(map[string]Device)
-	RegisterDevice("ht", NewProtonHT())
+	factories = make(map[string]Factory)
+	signatures = make(map[string]Signature)
+	RegisterDeviceFactory("ht", NewProtonHT)
+	RegisterSignature("ht", func(payload []byte) bool {
+		return len(payload) == htPayloadLength
+	})
+	RegisterDeviceFactory("script", NewScriptDevice)
 }
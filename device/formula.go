@@ -0,0 +1,14 @@
+package device
+
+import "math"
+
+func dewPoint(temperature float64, humidity float64) float64 {
+	alpha := math.Log(humidity/100.0) + (17.625*temperature)/(243.04+temperature)
+	return (243.04 * alpha) / (17.624 - alpha)
+}
+
+func absoluteHumidity(temperature float64, humidity float64) float64 {
+	PSat := 6.112 * math.Pow(math.E, (17.67*temperature)/(temperature+243.5))
+	P := PSat * (humidity / 100.0)
+	return ((P * 2.1674) / (273.15 + temperature)) * 1000.0 * 1000.0
+}
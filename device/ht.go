@@ -3,12 +3,15 @@ package device
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
-	"math"
+	"proton-gateway/battery"
+	"proton-gateway/config"
 	"proton-gateway/homeassistant"
 	"proton-gateway/message"
 	"proton-gateway/packet"
-	"time"
+	"proton-gateway/store"
+	"proton-gateway/topic"
 )
 
 type payload struct {
@@ -19,107 +22,179 @@ type payload struct {
 	AbsoluteHumidity float32 `json:"absolute_humidity"`
 	DewPoint         float32 `json:"dew_point"`
 	Level            float32 `json:"battery_level"`
+	BatteryLow       *bool   `json:"battery_low,omitempty"`
 }
 
+type command struct {
+	Interval *uint16 `json:"interval,omitempty"`
+	Led      *bool   `json:"led,omitempty"`
+	Reboot   *bool   `json:"reboot,omitempty"`
+}
+
+// htPayloadLength is the size of a report: temperature, humidity, battery
+// voltage and current as little endian float32.
+const htPayloadLength = 16
+
+const (
+	opSetInterval uint8 = 0x01
+	opLed         uint8 = 0x02
+	opReboot      uint8 = 0x03
+)
+
 type ProtonHT struct {
-	messageTimestamps map[string]time.Time
+	conf      config.DeviceConfig
+	layout    *topic.Layout
+	viaDevice string
+	state     store.Store
+	last      *payload
+	battery   battery.Profile
+	low       float64
 }
 
-func NewProtonHT() Device {
+func NewProtonHT(conf config.DeviceConfig, layout *topic.Layout) Device {
+	profile, _ := battery.Lookup(battery.ProfileLinear, nil)
+
 	return &ProtonHT{
-		messageTimestamps: make(map[string]time.Time),
+		conf:    conf,
+		layout:  layout,
+		battery: profile,
 	}
 }
 
-func (dev ProtonHT) deviceConfig(mac string) *homeassistant.DeviceConfig {
+// Start selects the battery profile.
+func (dev *ProtonHT) Start() error {
+	profile, low, err := batteryOf(dev.conf)
+	if err != nil {
+		return err
+	}
+	dev.battery, dev.low = profile, low
+
+	return nil
+}
+
+// batteryOf returns the battery profile of a device, linear unless configured
+// otherwise, and the level below which its battery is reported low.
+func batteryOf(conf config.DeviceConfig) (battery.Profile, float64, error) {
+	profile, _ := battery.Lookup(battery.ProfileLinear, nil)
+	if conf.Battery == nil {
+		return profile, 0, nil
+	}
+
+	if conf.Battery.Profile != "" {
+		var err error
+		profile, err = battery.Lookup(conf.Battery.Profile, conf.Battery.Points)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return profile, conf.Battery.Low, nil
+}
+
+func (dev *ProtonHT) deviceConfig() *homeassistant.DeviceConfig {
 	conf := homeassistant.NewDeviceConfig()
-	conf.AddIdentifier(dev.Id(mac))
+	conf.AddIdentifier(dev.Id())
 	conf.SetManufacturer("espressif")
 	conf.SetModel("lolin32-lite")
-	conf.SetName(dev.Id(mac))
+	conf.SetName(dev.Id())
+	if dev.conf.Name != "" {
+		conf.SetName(dev.conf.Name)
+	}
 	conf.SetSoftwareVersion("v0.0.1")
+	if dev.viaDevice != "" {
+		conf.SetViaDevice(dev.viaDevice)
+	}
 
 	return conf
 }
 
-func (dev ProtonHT) entityConfig(mac string, entity string) *homeassistant.EntityConfig {
+func (dev *ProtonHT) entityConfig(entity string) *homeassistant.EntityConfig {
 	conf := homeassistant.NewEntityConfig()
-	conf.SetAvailabilityTopic(dev.availabilityTopic(mac))
-	conf.SetObjectId(fmt.Sprintf("%s_%s", dev.Id(mac), entity))
-	conf.SetUniqueId(fmt.Sprintf("%s_%s", dev.Id(mac), entity))
-	conf.SetPayloadAvailable("online")
-	conf.SetPayloadNotAvailable("offline")
-	conf.Device = dev.deviceConfig(mac)
+	conf.AddAvailability(homeassistant.BridgeStatusTopic(dev.layout), "online", "offline")
+	conf.AddAvailability(dev.availabilityTopic(), "online", "offline")
+	conf.SetAvailabilityMode(homeassistant.AvailabilityModeAll)
+	conf.SetObjectId(fmt.Sprintf("%s_%s", dev.Id(), entity))
+	conf.SetUniqueId(fmt.Sprintf("%s_%s", dev.Id(), entity))
+	conf.Device = dev.deviceConfig()
+
+	return conf
+}
+
+func (dev *ProtonHT) sensorConfig(entity string) *homeassistant.SensorConfig {
+	conf := homeassistant.NewSensorConfig(dev.entityConfig(entity))
+	if dev.conf.Timeout > 0 {
+		conf.SetExpireAfter(int(dev.conf.Timeout.Seconds()))
+	}
 
 	return conf
 }
 
-func (dev ProtonHT) temperatureConfig(mac string) message.Message {
-	conf := homeassistant.NewSensorConfig(dev.entityConfig(mac, "temperature"))
+func (dev *ProtonHT) temperatureConfig() message.Message {
+	conf := dev.sensorConfig("temperature")
 
 	conf.SetDeviceClass("temperature")
 	conf.SetValueTemplate("{{ value_json.temperature | round(1) }}")
 	conf.SetStateClass("measurement")
 	conf.SetUnitOfMeasurement("°C")
 	conf.SetName("Temperature")
-	conf.SetStateTopic(dev.stateTopic(mac))
+	conf.SetStateTopic(dev.StateTopic())
 
 	return dev.configToMessage(
-		homeassistant.AutoDiscoveryTopic(homeassistant.EntityTypeSensor, dev.Id(mac), "temperature"),
+		homeassistant.AutoDiscoveryTopic(dev.layout, homeassistant.EntityTypeSensor, dev.topicDevice(), "temperature"),
 		&conf,
 	)
 }
 
-func (dev ProtonHT) humidityConfig(mac string) message.Message {
-	conf := homeassistant.NewSensorConfig(dev.entityConfig(mac, "humidity"))
+func (dev *ProtonHT) humidityConfig() message.Message {
+	conf := dev.sensorConfig("humidity")
 
 	conf.SetDeviceClass("humidity")
 	conf.SetValueTemplate("{{ value_json.humidity | round(1) }}")
 	conf.SetStateClass("measurement")
 	conf.SetUnitOfMeasurement("%")
 	conf.SetName("Humidity")
-	conf.SetStateTopic(dev.stateTopic(mac))
+	conf.SetStateTopic(dev.StateTopic())
 
 	return dev.configToMessage(
-		homeassistant.AutoDiscoveryTopic(homeassistant.EntityTypeSensor, dev.Id(mac), "humidity"),
+		homeassistant.AutoDiscoveryTopic(dev.layout, homeassistant.EntityTypeSensor, dev.topicDevice(), "humidity"),
 		&conf,
 	)
 }
 
-func (dev ProtonHT) dewPointConfig(mac string) message.Message {
-	conf := homeassistant.NewSensorConfig(dev.entityConfig(mac, "dew_point"))
+func (dev *ProtonHT) dewPointConfig() message.Message {
+	conf := dev.sensorConfig("dew_point")
 
 	conf.SetDeviceClass("temperature")
 	conf.SetValueTemplate("{{ value_json.dew_point | round(1) }}")
 	conf.SetStateClass("measurement")
 	conf.SetUnitOfMeasurement("°C")
 	conf.SetName("Dew Point")
-	conf.SetStateTopic(dev.stateTopic(mac))
+	conf.SetStateTopic(dev.StateTopic())
 
 	return dev.configToMessage(
-		homeassistant.AutoDiscoveryTopic(homeassistant.EntityTypeSensor, dev.Id(mac), "dew_point"),
+		homeassistant.AutoDiscoveryTopic(dev.layout, homeassistant.EntityTypeSensor, dev.topicDevice(), "dew_point"),
 		&conf,
 	)
 }
 
-func (dev ProtonHT) absoluteHumidityConfig(mac string) message.Message {
-	conf := homeassistant.NewSensorConfig(dev.entityConfig(mac, "absolute_humidity"))
+func (dev *ProtonHT) absoluteHumidityConfig() message.Message {
+	conf := dev.sensorConfig("absolute_humidity")
 
 	conf.SetDeviceClass("water")
 	conf.SetValueTemplate("{{ value_json.absolute_humidity | round(1) }}")
 	conf.SetStateClass("measurement")
 	conf.SetUnitOfMeasurement("mg/m³")
 	conf.SetName("Absolute Humidity")
-	conf.SetStateTopic(dev.stateTopic(mac))
+	conf.SetStateTopic(dev.StateTopic())
 
 	return dev.configToMessage(
-		homeassistant.AutoDiscoveryTopic(homeassistant.EntityTypeSensor, dev.Id(mac), "absolute_humidity"),
+		homeassistant.AutoDiscoveryTopic(dev.layout, homeassistant.EntityTypeSensor, dev.topicDevice(), "absolute_humidity"),
 		&conf,
 	)
 }
 
-func (dev ProtonHT) voltageConfig(mac string) message.Message {
-	conf := homeassistant.NewSensorConfig(dev.entityConfig(mac, "battery_voltage"))
+func (dev *ProtonHT) voltageConfig() message.Message {
+	conf := dev.sensorConfig("battery_voltage")
 
 	conf.SetDeviceClass("voltage")
 	conf.SetValueTemplate("{{ value_json.battery_voltage | round(2) }}")
@@ -127,16 +202,16 @@ func (dev ProtonHT) voltageConfig(mac string) message.Message {
 	conf.SetUnitOfMeasurement("V")
 	conf.SetName("Battery Voltage")
 	conf.SetEntityCategory("diagnostic")
-	conf.SetStateTopic(dev.stateTopic(mac))
+	conf.SetStateTopic(dev.StateTopic())
 
 	return dev.configToMessage(
-		homeassistant.AutoDiscoveryTopic(homeassistant.EntityTypeSensor, dev.Id(mac), "battery_voltage"),
+		homeassistant.AutoDiscoveryTopic(dev.layout, homeassistant.EntityTypeSensor, dev.topicDevice(), "battery_voltage"),
 		&conf,
 	)
 }
 
-func (dev ProtonHT) currentConfig(mac string) message.Message {
-	conf := homeassistant.NewSensorConfig(dev.entityConfig(mac, "battery_current"))
+func (dev *ProtonHT) currentConfig() message.Message {
+	conf := dev.sensorConfig("battery_current")
 
 	conf.SetDeviceClass("current")
 	conf.SetValueTemplate("{{ value_json.battery_current | round(2) }}")
@@ -144,16 +219,16 @@ func (dev ProtonHT) currentConfig(mac string) message.Message {
 	conf.SetUnitOfMeasurement("mA")
 	conf.SetName("Battery Current")
 	conf.SetEntityCategory("diagnostic")
-	conf.SetStateTopic(dev.stateTopic(mac))
+	conf.SetStateTopic(dev.StateTopic())
 
 	return dev.configToMessage(
-		homeassistant.AutoDiscoveryTopic(homeassistant.EntityTypeSensor, dev.Id(mac), "battery_current"),
+		homeassistant.AutoDiscoveryTopic(dev.layout, homeassistant.EntityTypeSensor, dev.topicDevice(), "battery_current"),
 		&conf,
 	)
 }
 
-func (dev ProtonHT) levelConfig(mac string) message.Message {
-	conf := homeassistant.NewSensorConfig(dev.entityConfig(mac, "battery_level"))
+func (dev *ProtonHT) levelConfig() message.Message {
+	conf := dev.sensorConfig("battery_level")
 
 	conf.SetDeviceClass("battery")
 	conf.SetValueTemplate("{{ value_json.battery_level | round(2) }}")
@@ -161,19 +236,37 @@ func (dev ProtonHT) levelConfig(mac string) message.Message {
 	conf.SetUnitOfMeasurement("%")
 	conf.SetName("Battery Level")
 	conf.SetEntityCategory("diagnostic")
-	conf.SetStateTopic(dev.stateTopic(mac))
+	conf.SetStateTopic(dev.StateTopic())
+
+	return dev.configToMessage(
+		homeassistant.AutoDiscoveryTopic(dev.layout, homeassistant.EntityTypeSensor, dev.topicDevice(), "battery_level"),
+		&conf,
+	)
+}
+
+func (dev *ProtonHT) batteryLowConfig() message.Message {
+	conf := homeassistant.NewBinarySensorConfig(dev.entityConfig("battery_low"))
+	if dev.conf.Timeout > 0 {
+		conf.SetExpireAfter(int(dev.conf.Timeout.Seconds()))
+	}
+
+	conf.SetDeviceClass("battery")
+	conf.SetValueTemplate("{{ 'ON' if value_json.battery_low else 'OFF' }}")
+	conf.SetName("Battery Low")
+	conf.SetEntityCategory("diagnostic")
+	conf.SetStateTopic(dev.StateTopic())
 
 	return dev.configToMessage(
-		homeassistant.AutoDiscoveryTopic(homeassistant.EntityTypeSensor, dev.Id(mac), "battery_level"),
+		homeassistant.AutoDiscoveryTopic(dev.layout, homeassistant.EntityTypeBinarySensor, dev.topicDevice(), "battery_low"),
 		&conf,
 	)
 }
 
-func (dev ProtonHT) Id(mac string) string {
-	return fmt.Sprintf("protonht-%s", mac)
+func (dev *ProtonHT) Id() string {
+	return fmt.Sprintf("protonht-%s", dev.conf.Mac)
 }
 
-func (dev ProtonHT) configToMessage(topic string, config interface{}) message.Message {
+func (dev *ProtonHT) configToMessage(topic string, config interface{}) message.Message {
 	msg, err := message.Json(topic, config, true, 0)
 	if err != nil {
 		panic(err)
@@ -182,99 +275,166 @@ func (dev ProtonHT) configToMessage(topic string, config interface{}) message.Me
 	return msg
 }
 
-func (dev ProtonHT) Configuration(mac string) []message.Message {
-	return []message.Message{
-		dev.temperatureConfig(mac),
-		dev.humidityConfig(mac),
-		dev.absoluteHumidityConfig(mac),
-		dev.dewPointConfig(mac),
-		dev.voltageConfig(mac),
-		dev.currentConfig(mac),
-		dev.levelConfig(mac),
+func (dev *ProtonHT) Configuration(viaDevice string) []message.Message {
+	dev.viaDevice = viaDevice
+
+	messages := []message.Message{
+		dev.temperatureConfig(),
+		dev.humidityConfig(),
+		dev.absoluteHumidityConfig(),
+		dev.dewPointConfig(),
+		dev.voltageConfig(),
+		dev.currentConfig(),
+		dev.levelConfig(),
+	}
+	if dev.low > 0 {
+		messages = append(messages, dev.batteryLowConfig())
 	}
+
+	return messages
 }
 
-func (dev ProtonHT) Process(packet packet.Packet) []message.Message {
+func (dev *ProtonHT) Process(packet packet.Packet) []message.Message {
 	reader := bytes.NewReader(packet.Payload())
 	payload := payload{}
 
 	err := binary.Read(reader, binary.LittleEndian, &(payload.Temperature))
 	if err != nil {
-		return dev.offline(packet.Mac())
+		return dev.Offline()
 	}
 	err = binary.Read(reader, binary.LittleEndian, &(payload.Humidity))
 	if err != nil {
-		return dev.offline(packet.Mac())
+		return dev.Offline()
 	}
 	err = binary.Read(reader, binary.LittleEndian, &(payload.Voltage))
 	if err != nil {
-		return dev.offline(packet.Mac())
+		return dev.Offline()
 	}
 	err = binary.Read(reader, binary.LittleEndian, &(payload.Current))
 	if err != nil {
-		return dev.offline(packet.Mac())
+		return dev.Offline()
 	}
 
-	payload.AbsoluteHumidity = dev.absoluteHumidity(payload.Temperature, payload.Humidity)
-	payload.DewPoint = dev.dewPoint(payload.Temperature, payload.Humidity)
-	payload.Level = dev.level(payload.Voltage)
+	payload.Temperature = dev.calibrate("temperature", payload.Temperature)
+	payload.Humidity = dev.calibrate("humidity", payload.Humidity)
+	payload.Voltage = dev.calibrate("battery_voltage", payload.Voltage)
+	payload.Current = dev.calibrate("battery_current", payload.Current)
 
-	availabilityPayload := "online"
-	if packet.Timestamp().Sub(dev.lastMessage(packet.Mac())) >= 3*time.Minute {
-		availabilityPayload = "offline"
+	temperature, humidity := float64(payload.Temperature), float64(payload.Humidity)
+	payload.AbsoluteHumidity = float32(absoluteHumidity(temperature, humidity))
+	payload.DewPoint = float32(dewPoint(temperature, humidity))
+	payload.Level = dev.level(payload.Voltage)
+	if dev.low > 0 {
+		low := float64(payload.Level) < dev.low
+		payload.BatteryLow = &low
 	}
 
-	stateMessage, err := message.Json(dev.stateTopic(packet.Mac()), &payload, false, 0)
+	stateMessage, err := message.Json(dev.StateTopic(), &payload, false, 0)
 	if err != nil {
-		return dev.offline(packet.Mac())
+		return dev.Offline()
 	}
 
-	dev.logMessage(packet.Mac(), packet.Timestamp())
+	dev.last = &payload
+	if dev.state != nil {
+		_ = dev.state.Set(dev.stateKey(), &payload)
+	}
 
 	return []message.Message{
-		message.NewMessage(dev.availabilityTopic(packet.Mac()), []byte(availabilityPayload), true, 0),
+		message.NewMessage(dev.availabilityTopic(), []byte("online"), true, 0),
 		stateMessage,
 	}
 }
 
-func (dev ProtonHT) lastMessage(mac string) time.Time {
-	timestamp, found := dev.messageTimestamps[mac]
-	if !found {
-		return time.Now()
+func (dev *ProtonHT) Restore(state store.Store) error {
+	dev.state = state
+
+	last := payload{}
+	found, err := state.Get(dev.stateKey(), &last)
+	if err != nil {
+		return err
+	}
+	if found {
+		dev.last = &last
 	}
 
-	return timestamp
+	return nil
 }
 
-func (dev ProtonHT) logMessage(mac string, time time.Time) {
-	dev.messageTimestamps[mac] = time
+func (dev *ProtonHT) LastState() []message.Message {
+	if dev.last == nil {
+		return nil
+	}
+
+	stateMessage, err := message.Json(dev.StateTopic(), dev.last, false, 0)
+	if err != nil {
+		return nil
+	}
+
+	return []message.Message{stateMessage}
 }
 
-func (dev ProtonHT) offline(mac string) []message.Message {
+func (dev *ProtonHT) Command(payload []byte) ([]byte, error) {
+	cmd := command{}
+	if err := json.Unmarshal(payload, &cmd); err != nil {
+		return nil, ErrInvalidCommand
+	}
+
+	frame := bytes.Buffer{}
+	if cmd.Interval != nil {
+		frame.WriteByte(opSetInterval)
+		_ = binary.Write(&frame, binary.LittleEndian, *cmd.Interval)
+	}
+	if cmd.Led != nil && *cmd.Led {
+		frame.WriteByte(opLed)
+	}
+	if cmd.Reboot != nil && *cmd.Reboot {
+		frame.WriteByte(opReboot)
+	}
+
+	if frame.Len() == 0 {
+		return nil, ErrInvalidCommand
+	}
+
+	return frame.Bytes(), nil
+}
+
+func (dev *ProtonHT) Offline() []message.Message {
 	return []message.Message{
-		message.NewMessage(dev.availabilityTopic(mac), []byte("offline"), true, 0),
+		message.NewMessage(dev.availabilityTopic(), []byte("offline"), true, 0),
 	}
 }
 
-func (dev ProtonHT) stateTopic(mac string) string {
-	return fmt.Sprintf("protons/protonht-%s/state", mac)
+func (dev *ProtonHT) stateKey() string {
+	return fmt.Sprintf("%s/state", dev.Id())
+}
+
+func (dev *ProtonHT) StateTopic() string {
+	return dev.layout.State(dev.topicDevice())
+}
+
+func (dev *ProtonHT) CommandTopic() string {
+	return dev.layout.Command(dev.topicDevice())
 }
 
-func (dev ProtonHT) availabilityTopic(mac string) string {
-	return fmt.Sprintf("protons/protonht-%s/status", mac)
+func (dev *ProtonHT) availabilityTopic() string {
+	return dev.layout.Availability(dev.topicDevice())
 }
 
-func (dev ProtonHT) dewPoint(temperature float32, humidity float32) float32 {
-	alpha := float32(math.Log(float64(humidity/100.0))) + (17.625*temperature)/(243.04+temperature)
-	return (243.04 * alpha) / (17.624 - alpha)
+func (dev *ProtonHT) topicDevice() topic.Device {
+	return topic.NewDevice(dev.conf, dev.Id())
 }
 
-func (dev ProtonHT) absoluteHumidity(temperature float32, humidity float32) float32 {
-	PSat := 6.112 * float32(math.Pow(math.E, float64((17.67*temperature)/(temperature+243.5))))
-	P := PSat * (humidity / 100.0)
-	return ((P * 2.1674) / (273.15 + temperature)) * 1000.0 * 1000.0
+// calibrate corrects a raw reading by the calibration configured for the
+// field, named like in the published state.
+func (dev *ProtonHT) calibrate(field string, raw float32) float32 {
+	calibration, found := dev.conf.Calibration[field]
+	if !found {
+		return raw
+	}
+
+	return float32(calibration.Apply(float64(raw)))
 }
 
-func (dev ProtonHT) level(voltage float32) float32 {
-	return voltage*100.0 - 320.0
+func (dev *ProtonHT) level(voltage float32) float32 {
+	return float32(dev.battery.Level(float64(voltage)))
 }
@@ -0,0 +1,325 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+	"math"
+	"proton-gateway/config"
+	"proton-gateway/message"
+	"proton-gateway/packet"
+	"proton-gateway/topic"
+	"time"
+)
+
+// ScriptDevice decodes payloads with a Starlark script referenced by the
+// device configuration. The script defines decode(packet), returning a dict
+// of field values, and may describe how fields are announced to Home
+// Assistant in a global entities dict:
+//
+//	entities = {"temperature": {"unit": "°C", "device_class": "temperature"}}
+//
+//	def decode(packet):
+//	    return {"temperature": unpack("float32le", packet.payload, 0)}
+type ScriptDevice struct {
+	DefinedDevice
+
+	log      *log.Entry
+	thread   *starlark.Thread
+	decode   starlark.Value
+	entities []EntityDefinition
+}
+
+var ErrInvalidScript = errors.New("device: invalid script")
+
+// scriptMaxSteps limits every run of a script, so a runaway decode fails
+// instead of stalling the pipeline.
+const scriptMaxSteps = 1000000
+
+// scriptOptions keeps scripts to the standard dialect, which has floats and
+// lambdas, independent of the legacy globals of the resolve package.
+var scriptOptions = &syntax.FileOptions{}
+
+func NewScriptDevice(conf config.DeviceConfig, layout *topic.Layout) Device {
+	return &ScriptDevice{
+		DefinedDevice: DefinedDevice{
+			def: &Definition{
+				Type:     conf.Type,
+				IdPrefix: "protonscript",
+			},
+			conf:   conf,
+			layout: layout,
+		},
+		log: log.WithField("device", conf.Mac),
+	}
+}
+
+// Start loads the script, so a broken script only disables its device.
+func (dev *ScriptDevice) Start() error {
+	if dev.conf.Script == "" {
+		return fmt.Errorf("%w: no script configured", ErrInvalidScript)
+	}
+
+	dev.thread = &starlark.Thread{
+		Name: dev.Id(),
+		Print: func(_ *starlark.Thread, msg string) {
+			dev.log.Info(msg)
+		},
+	}
+	dev.thread.SetMaxExecutionSteps(scriptMaxSteps)
+
+	globals, err := starlark.ExecFileOptions(scriptOptions, dev.thread, dev.conf.Script, nil, scriptBuiltins())
+	if err != nil {
+		return err
+	}
+
+	decode, found := globals["decode"]
+	if _, callable := decode.(starlark.Callable); !found || !callable {
+		return fmt.Errorf("%w: %s does not define decode(packet)", ErrInvalidScript, dev.conf.Script)
+	}
+	dev.decode = decode
+
+	if entities, found := globals["entities"]; found {
+		dev.entities, err = scriptEntities(entities)
+		if err != nil {
+			return err
+		}
+	}
+
+	if manufacturer, ok := starlark.AsString(globals["manufacturer"]); ok {
+		dev.def.Manufacturer = manufacturer
+	}
+	if model, ok := starlark.AsString(globals["model"]); ok {
+		dev.def.Model = model
+	}
+
+	return nil
+}
+
+func (dev *ScriptDevice) Configuration(viaDevice string) []message.Message {
+	dev.viaDevice = viaDevice
+
+	messages := make([]message.Message, 0, len(dev.entities))
+	for _, entity := range dev.entities {
+		messages = append(messages, dev.entityConfig(entity))
+	}
+
+	return messages
+}
+
+// Process runs decode for the packet. Script errors are logged and published
+// to the device's error topic instead of stopping the pipeline.
+func (dev *ScriptDevice) Process(packet packet.Packet) []message.Message {
+	values, err := dev.run(packet)
+	if err != nil {
+		dev.log.Warnf("script %s failed: %v", dev.conf.Script, err)
+		return []message.Message{
+			message.NewMessage(dev.errorTopic(), []byte(err.Error()), false, 0),
+		}
+	}
+
+	stateMessage, err := message.Json(dev.StateTopic(), values, false, 0)
+	if err != nil {
+		return dev.Offline()
+	}
+	dev.remember(values)
+
+	return []message.Message{
+		message.NewMessage(dev.availabilityTopic(), []byte("online"), true, 0),
+		stateMessage,
+	}
+}
+
+func (dev *ScriptDevice) run(p packet.Packet) (map[string]interface{}, error) {
+	payload := make([]starlark.Value, len(p.Payload()))
+	for i, b := range p.Payload() {
+		payload[i] = starlark.MakeInt(int(b))
+	}
+
+	arg := starlarkstruct.FromStringDict(starlark.String("packet"), starlark.StringDict{
+		"mac":       starlark.String(p.Mac()),
+		"payload":   starlark.NewList(payload),
+		"rssi":      starlark.MakeInt(int(p.Rssi())),
+		"gateway":   starlark.String(p.Gateway()),
+		"timestamp": starlark.Float(float64(p.Timestamp().UnixNano()) / float64(time.Second)),
+	})
+
+	// the step limit applies per call, not over the lifetime of the thread
+	dev.thread.Steps = 0
+	dev.thread.Uncancel()
+	result, err := starlark.Call(dev.thread, dev.decode, starlark.Tuple{arg}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, ok := result.(*starlark.Dict)
+	if !ok {
+		return nil, fmt.Errorf("%w: decode returned %s instead of a dict", ErrInvalidScript, result.Type())
+	}
+
+	values := make(map[string]interface{})
+	for _, item := range fields.Items() {
+		name, ok := starlark.AsString(item[0])
+		if !ok {
+			return nil, fmt.Errorf("%w: field name %s is not a string", ErrInvalidScript, item[0])
+		}
+
+		value, err := scriptValue(item[1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: field %s: %v", ErrInvalidScript, name, err)
+		}
+		values[name] = value
+	}
+
+	return values, nil
+}
+
+func (dev *ScriptDevice) errorTopic() string {
+	return dev.layout.Join(dev.Id(), "error")
+}
+
+func scriptValue(value starlark.Value) (interface{}, error) {
+	switch v := value.(type) {
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.String:
+		return string(v), nil
+	case starlark.Int:
+		if i, ok := v.Int64(); ok {
+			return i, nil
+		}
+	case starlark.Float:
+		f := float64(v)
+		if !finite(f) {
+			return nil, nil
+		}
+		return f, nil
+	}
+
+	return nil, fmt.Errorf("unsupported value %s", value.Type())
+}
+
+func scriptEntities(value starlark.Value) ([]EntityDefinition, error) {
+	dict, ok := value.(*starlark.Dict)
+	if !ok {
+		return nil, fmt.Errorf("%w: entities must be a dict", ErrInvalidScript)
+	}
+
+	var entities []EntityDefinition
+	for _, item := range dict.Items() {
+		name, ok := starlark.AsString(item[0])
+		if !ok {
+			return nil, fmt.Errorf("%w: entity name %s is not a string", ErrInvalidScript, item[0])
+		}
+		metadata, ok := item[1].(*starlark.Dict)
+		if !ok {
+			return nil, fmt.Errorf("%w: entity %s must be a dict", ErrInvalidScript, name)
+		}
+
+		entity := EntityDefinition{Name: name}
+		for _, attribute := range metadata.Items() {
+			key, _ := starlark.AsString(attribute[0])
+			text, _ := starlark.AsString(attribute[1])
+
+			switch key {
+			case "title":
+				entity.Title = text
+			case "unit":
+				entity.Unit = text
+			case "device_class":
+				entity.DeviceClass = text
+			case "state_class":
+				entity.StateClass = text
+			case "entity_category":
+				entity.EntityCategory = text
+			case "precision":
+				precision, err := starlark.AsInt32(attribute[1])
+				if err != nil {
+					return nil, fmt.Errorf("%w: precision of %s: %v", ErrInvalidScript, name, err)
+				}
+				entity.Precision = &precision
+			default:
+				return nil, fmt.Errorf("%w: unknown attribute %s of entity %s", ErrInvalidScript, attribute[0], name)
+			}
+		}
+
+		entities = append(entities, entity)
+	}
+
+	return entities, nil
+}
+
+// scriptBuiltins exposes the field types and functions of device definitions
+// to scripts, along with a few math helpers.
+func scriptBuiltins() starlark.StringDict {
+	builtins := starlark.StringDict{
+		"unpack": starlark.NewBuiltin("unpack", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var name string
+			var payload *starlark.List
+			var offset int
+			if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 3, &name, &payload, &offset); err != nil {
+				return nil, err
+			}
+
+			ft, found := fieldTypes[name]
+			if !found {
+				return nil, fmt.Errorf("unpack: unknown type %s", name)
+			}
+			if offset < 0 || offset+ft.size > payload.Len() {
+				return nil, fmt.Errorf("unpack: %s at offset %d exceeds payload of %d bytes", name, offset, payload.Len())
+			}
+
+			data := make([]byte, ft.size)
+			for i := range data {
+				b, err := starlark.AsInt32(payload.Index(offset + i))
+				if err != nil {
+					return nil, fmt.Errorf("unpack: %v", err)
+				}
+				data[i] = byte(b)
+			}
+
+			return starlark.Float(ft.decode(data)), nil
+		}),
+	}
+
+	for name, fn := range functions {
+		builtins[name] = floatBuiltin(name, fn.inputs, fn.apply)
+	}
+
+	builtins["sqrt"] = floatBuiltin("sqrt", 1, func(inputs []float64) float64 {
+		return math.Sqrt(inputs[0])
+	})
+	builtins["exp"] = floatBuiltin("exp", 1, func(inputs []float64) float64 {
+		return math.Exp(inputs[0])
+	})
+	builtins["log"] = floatBuiltin("log", 1, func(inputs []float64) float64 {
+		return math.Log(inputs[0])
+	})
+	builtins["pow"] = floatBuiltin("pow", 2, func(inputs []float64) float64 {
+		return math.Pow(inputs[0], inputs[1])
+	})
+
+	return builtins
+}
+
+func floatBuiltin(name string, arity int, apply func(inputs []float64) float64) *starlark.Builtin {
+	return starlark.NewBuiltin(name, func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		if len(args) != arity || len(kwargs) != 0 {
+			return nil, fmt.Errorf("%s: takes exactly %d positional arguments", name, arity)
+		}
+
+		inputs := make([]float64, arity)
+		for i, arg := range args {
+			f, ok := starlark.AsFloat(arg)
+			if !ok {
+				return nil, fmt.Errorf("%s: argument %d is %s, not a number", name, i+1, arg.Type())
+			}
+			inputs[i] = f
+		}
+
+		return starlark.Float(apply(inputs)), nil
+	})
+}
@@ -0,0 +1,38 @@
+package device
+
+import (
+	"os"
+	"path/filepath"
+	"proton-gateway/config"
+	"proton-gateway/packet"
+	"testing"
+	"time"
+)
+
+// TestScriptDeviceDecodes runs a script using floats and lambdas, which the
+// standard dialect allows without touching the resolve globals.
+func TestScriptDeviceDecodes(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "level.star")
+	source := `
+scale = lambda raw: raw * 0.5
+
+def decode(packet):
+    return {"level": scale(packet.payload[0])}
+`
+	if err := os.WriteFile(script, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dev := NewScriptDevice(config.DeviceConfig{Type: "script", Mac: "0123456789ab", Script: script}, defaultLayout(t)).(*ScriptDevice)
+	if err := dev.Start(); err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+
+	messages := dev.Process(packet.New("0123456789ab", time.Now(), []byte{5}, "default", packet.RssiUnknown))
+	if len(messages) != 2 {
+		t.Fatalf("Process() = %d messages, want 2", len(messages))
+	}
+	if payload := string(messages[1].Payload()); payload != `{"level":2.5}` {
+		t.Errorf("Process() state = %s, want {\"level\":2.5}", payload)
+	}
+}
@@ -0,0 +1,192 @@
+package discovery
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"proton-gateway/config"
+	"proton-gateway/device"
+	"proton-gateway/message"
+	"proton-gateway/packet"
+	"proton-gateway/topic"
+	"proton-gateway/utils"
+	"sort"
+	"sync"
+	"time"
+)
+
+func PendingTopic(layout *topic.Layout) string {
+	return layout.Join("discovery", "pending")
+}
+
+func AdoptTopic(layout *topic.Layout) string {
+	return layout.Join("discovery", "adopt")
+}
+
+// Pending is an unknown device heard by one of the gateways. Type is a guess
+// based on the payload and may be empty.
+type Pending struct {
+	Mac       string    `json:"mac"`
+	Type      string    `json:"type,omitempty"`
+	Length    int       `json:"length"`
+	Count     int       `json:"count"`
+	Gateway   string    `json:"gateway"`
+	Rssi      *int8     `json:"rssi,omitempty"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Samples   []string  `json:"samples"`
+}
+
+// Adoption asks the bridge to start handling a device. Type defaults to the
+// guessed type of the pending device.
+type Adoption struct {
+	Mac  string `json:"mac"`
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+var ErrUnknownType = errors.New("discovery: device type unknown")
+var ErrBusy = errors.New("discovery: too many adoptions in progress")
+
+// Discovery records unknown devices until they are adopted.
+type Discovery struct {
+	lock      sync.Mutex
+	layout    *topic.Layout
+	samples   int
+	pending   map[string]*Pending
+	adoptions chan Adoption
+}
+
+func New(samples int, layout *topic.Layout) *Discovery {
+	return &Discovery{
+		layout:    layout,
+		samples:   samples,
+		pending:   make(map[string]*Pending),
+		adoptions: make(chan Adoption, 8),
+	}
+}
+
+// Record notes a packet of an unknown device and reports whether the device
+// was not pending before.
+func (d *Discovery) Record(p packet.Packet) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	pending, found := d.pending[p.Mac()]
+	if !found {
+		pending = &Pending{
+			Mac:       p.Mac(),
+			FirstSeen: p.Timestamp(),
+		}
+		d.pending[p.Mac()] = pending
+	}
+
+	pending.Type = device.GuessType(p.Payload())
+	pending.Length = len(p.Payload())
+	pending.Count++
+	pending.Gateway = p.Gateway()
+	pending.Rssi = nil
+	if rssi := p.Rssi(); rssi != packet.RssiUnknown {
+		pending.Rssi = &rssi
+	}
+	pending.LastSeen = p.Timestamp()
+
+	pending.Samples = append(pending.Samples, hex.EncodeToString(p.Payload()))
+	if len(pending.Samples) > d.samples {
+		pending.Samples = pending.Samples[len(pending.Samples)-d.samples:]
+	}
+
+	return !found
+}
+
+func (d *Discovery) Remove(mac string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	delete(d.pending, mac)
+}
+
+// Pending returns the pending devices ordered by MAC.
+func (d *Discovery) Pending() []Pending {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	pending := make([]Pending, 0, len(d.pending))
+	for _, p := range d.pending {
+		copied := *p
+		copied.Samples = append([]string(nil), p.Samples...)
+		pending = append(pending, copied)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Mac < pending[j].Mac
+	})
+
+	return pending
+}
+
+func (d *Discovery) Message() (message.Message, error) {
+	return message.Json(PendingTopic(d.layout), d.Pending(), true, 0)
+}
+
+// Adopt validates the request and queues it on Adoptions, with the MAC in
+// the lower case form packets carry. Whether the name is taken is only known
+// to the receiver of the adoption.
+func (d *Discovery) Adopt(adoption Adoption) error {
+	mac, err := utils.NormalizeMac(adoption.Mac)
+	if err != nil {
+		return err
+	}
+	adoption.Mac = mac
+
+	if err := config.CheckDeviceName(adoption.Name); err != nil {
+		return err
+	}
+
+	if adoption.Type == "" {
+		d.lock.Lock()
+		if pending, found := d.pending[adoption.Mac]; found {
+			adoption.Type = pending.Type
+		}
+		d.lock.Unlock()
+	}
+	if adoption.Type == "" {
+		return fmt.Errorf("%w: %s", ErrUnknownType, adoption.Mac)
+	}
+
+	select {
+	case d.adoptions <- adoption:
+		return nil
+	default:
+		return ErrBusy
+	}
+}
+
+func (d *Discovery) Adoptions() <-chan Adoption {
+	return d.adoptions
+}
+
+// ServeHTTP lists pending devices on GET and adopts the device posted as JSON
+// on POST.
+func (d *Discovery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(d.Pending())
+	case http.MethodPost:
+		adoption := Adoption{}
+		if err := json.NewDecoder(r.Body).Decode(&adoption); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := d.Adopt(adoption); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
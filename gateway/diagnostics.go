@@ -0,0 +1,89 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+)
+
+const rateWindow = time.Minute
+
+type Stats struct {
+	State            State  `json:"state"`
+	Resyncs          uint64 `json:"resyncs"`
+	Packets          uint64 `json:"packets"`
+	Dropped          uint64 `json:"dropped"`
+	PacketsPerMinute int    `json:"packets_per_minute"`
+	QueueDepth       int    `json:"queue_depth"`
+	LastError        string `json:"last_error"`
+}
+
+type stats struct {
+	lock       sync.Mutex
+	resyncs    uint64
+	packets    uint64
+	dropped    uint64
+	received   []time.Time
+	queueDepth int
+	lastError  string
+}
+
+func (s *stats) packet(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.packets++
+	s.received = append(s.trim(now), now)
+}
+
+func (s *stats) drop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.dropped++
+}
+
+func (s *stats) resync() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.resyncs++
+}
+
+func (s *stats) queue(depth int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.queueDepth = depth
+}
+
+func (s *stats) fail(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastError = err.Error()
+}
+
+func (s *stats) snapshot(state State) Stats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.received = s.trim(time.Now())
+	return Stats{
+		State:            state,
+		Resyncs:          s.resyncs,
+		Packets:          s.packets,
+		Dropped:          s.dropped,
+		PacketsPerMinute: len(s.received),
+		QueueDepth:       s.queueDepth,
+		LastError:        s.lastError,
+	}
+}
+
+func (s *stats) trim(now time.Time) []time.Time {
+	i := 0
+	for i < len(s.received) && now.Sub(s.received[i]) > rateWindow {
+		i++
+	}
+
+	return s.received[i:]
+}
@@ -1,25 +1,47 @@
 package gateway
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	log "github.com/sirupsen/logrus"
-	"github.com/tarm/serial"
+	"io"
+	"proton-gateway/config"
 	"proton-gateway/packet"
+	"proton-gateway/transport"
 	"proton-gateway/utils"
+	"sync"
 	"time"
 )
 
 type PacketHandler func(packet.Packet)
 
 type Gateway interface {
-	Start(packets PacketHandler) error
+	Start(ctx context.Context, packets PacketHandler) error
+	Send(ctx context.Context, mac string, payload []byte) error
+	Name() string
+	Mac() string
+	Version() string
+	Stats() Stats
+	State() State
+	OnStateChange(handler StateHandler)
+	Close() error
 }
 
 var ErrOutOfSync = errors.New("gateway: communication out of sync")
 var ErrComTimeout = errors.New("gateway: communication timeout")
 var ErrInvalidResponse = errors.New("gateway: invalid response")
+var ErrPayloadTooLarge = errors.New("gateway: payload too large")
+var ErrSendRejected = errors.New("gateway: packet rejected")
+var ErrNotConnected = errors.New("gateway: not connected")
+var ErrSendTimeout = errors.New("gateway: packet not sent in time")
 var syncDelay = 1 * time.Second
+var minReconnectDelay = 1 * time.Second
+var maxReconnectDelay = 30 * time.Second
+
+// sendMargin is added to the command timeouts bounding Send, for the packets
+// read before the poll loop transmits.
+var sendMargin = 5 * time.Second
 
 type Cmd uint8
 
@@ -29,51 +51,193 @@ const (
 	CmdRead         Cmd = 0xc3
 	CmdMessageCount Cmd = 0x24
 	CmdReadMac      Cmd = 0xa5
+	CmdSend         Cmd = 0x66
+	CmdReadVersion  Cmd = 0xe7
 )
 
+const unknownVersion = "unknown"
+
 const (
-	maxSyncAttempts      = 16
-	maxReconnectAttempts = 16
-	syncMagic            = 0x0055ffaa
+	maxSyncAttempts  = 16
+	syncMagic        = 0x0055ffaa
+	maxPayloadLength = 0xff
 )
 
+type outgoingPacket struct {
+	mac     []byte
+	payload []byte
+	result  chan error
+}
+
 type ProtonGateway struct {
-	config *serial.Config
-	port   *serial.Port
+	name     string
+	log      *log.Entry
+	mac      string
+	version  string
+	stats    stats
+	address  string
+	baudRate int
+	portLock sync.Mutex
+	port     transport.Transport
+	outgoing chan outgoingPacket
+	framing  packet.Options
+
+	timeouts      map[Cmd]time.Duration
+	timeoutPolicy TimeoutPolicy
+	maxTimeouts   int
+	timeoutCount  int
+	maxReconnects int
+
+	stateLock    sync.Mutex
+	state        State
+	stateHandler StateHandler
 }
 
-func OpenGateway(port string, baudRate int) (Gateway, error) {
-	gateway := ProtonGateway{
-		config: &serial.Config{Name: port, Baud: baudRate},
+func OpenGateway(conf config.GatewayConfig) (Gateway, error) {
+	policy, err := parseTimeoutPolicy(conf.TimeoutPolicy)
+	if err != nil {
+		return nil, err
 	}
-
-	com, err := serial.OpenPort(gateway.config)
+	checksum, err := packet.ParseChecksum(conf.Checksum)
 	if err != nil {
 		return nil, err
 	}
-	gateway.port = com
+	framing := packet.Options{
+		Gateway:   conf.Name,
+		Rssi:      conf.Rssi,
+		Checksum:  checksum,
+		MaxLength: int(conf.MaxPayload),
+	}
+
+	gateway := ProtonGateway{
+		name:          conf.Name,
+		log:           log.WithField("gateway", conf.Name),
+		address:       conf.Port,
+		baudRate:      int(conf.BaudRate),
+		outgoing:      make(chan outgoingPacket),
+		framing:       framing,
+		timeouts:      commandTimeouts(conf.Timeouts),
+		timeoutPolicy: policy,
+		maxTimeouts:   int(conf.MaxTimeouts),
+		maxReconnects: int(conf.MaxReconnects),
+		state:         StateConnecting,
+	}
 
-	err = gateway.synchronize()
+	// a gateway that is missing at startup is connected by Start later on
+	err = gateway.reconnect(context.Background())
+	if err == nil {
+		err = gateway.identify(context.Background())
+	}
 	if err != nil {
-		return nil, err
+		gateway.log.Warnf("gateway not connected: %v. Retrying in the background", err)
+		_ = gateway.Close()
 	}
 
 	return &gateway, nil
 }
 
-func (gw ProtonGateway) Start(handler PacketHandler) error {
-	if err := gw.ensureSynchronized(); err != nil {
+// Start polls the gateway and hands every received packet to handler. When
+// the connection fails it reconnects with backoff and resumes polling; it
+// only returns once reconnecting has been given up or ctx is done. A gateway
+// that could not be opened yet is connected the same way. Command
+// timeouts and out of sync replies are handled according to the configured
+// TimeoutPolicy.
+func (gw *ProtonGateway) Start(ctx context.Context, handler PacketHandler) error {
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			gw.interrupt()
+		case <-stopped:
+		}
+	}()
+
+	if !gw.connected() {
+		if err := gw.ensureConnected(ctx); err != nil {
+			gw.setState(StateDisconnected)
+			return err
+		}
+	}
+
+	for {
+		err := gw.poll(ctx, handler)
+		if ctx.Err() != nil {
+			_ = gw.Close()
+			gw.setState(StateDisconnected)
+			return ctx.Err()
+		}
+		gw.stats.fail(err)
+
+		if err == ErrComTimeout || err == ErrOutOfSync {
+			gw.timeoutCount++
+
+			switch gw.timeoutPolicy {
+			case TimeoutPolicyFail:
+				gw.setState(StateDisconnected)
+				return err
+			case TimeoutPolicyResync:
+				if gw.timeoutCount <= gw.maxTimeouts {
+					gw.stats.resync()
+					gw.log.Warnf("gateway command failed: %v. Resynchronizing %d/%d", err, gw.timeoutCount, gw.maxTimeouts)
+					continue
+				}
+			}
+		}
+		gw.timeoutCount = 0
+
+		gw.log.Errorf("gateway connection lost: %v", err)
+
+		if err := gw.ensureConnected(ctx); err != nil {
+			gw.setState(StateDisconnected)
+			return err
+		}
+	}
+}
+
+// interrupt closes the port so a command blocked in a read fails right away.
+func (gw *ProtonGateway) interrupt() {
+	gw.portLock.Lock()
+	defer gw.portLock.Unlock()
+
+	if gw.port != nil {
+		_ = gw.port.Close()
+	}
+}
+
+func (gw *ProtonGateway) connected() bool {
+	gw.portLock.Lock()
+	defer gw.portLock.Unlock()
+
+	return gw.port != nil
+}
+
+func (gw *ProtonGateway) Close() error {
+	gw.portLock.Lock()
+	defer gw.portLock.Unlock()
+
+	if gw.port == nil {
+		return nil
+	}
+
+	err := gw.port.Close()
+	gw.port = nil
+	return err
+}
+
+func (gw *ProtonGateway) poll(ctx context.Context, handler PacketHandler) error {
+	gw.setState(StateSynchronizing)
+	if err := gw.ensureSynchronized(ctx); err != nil {
 		return err
 	}
 
-	mac, err := gw.mac()
-	if err != nil {
+	if err := gw.identify(ctx); err != nil {
 		return err
 	}
-	log.Infof("Gateway mac address: %s", mac)
+	gw.setState(StateConnected)
 
 	for {
-		if err := gw.ensureSynchronized(); err != nil {
+		if err := gw.ensureSynchronized(ctx); err != nil {
 			return err
 		}
 
@@ -83,10 +247,15 @@ func (gw ProtonGateway) Start(handler PacketHandler) error {
 		}
 		for messageCount > 0 {
 			received, err := gw.receivePacket()
-			if err != nil {
+			if packet.IsCorrupt(err) {
+				gw.stats.drop()
+				gw.log.Warnf("dropping corrupt frame: %v", err)
+			} else if err != nil {
 				return err
+			} else {
+				gw.stats.packet(received.Timestamp())
+				handler(received)
 			}
-			handler(received)
 
 			messageCount, err = gw.messageCount()
 			if err != nil {
@@ -94,13 +263,200 @@ func (gw ProtonGateway) Start(handler PacketHandler) error {
 			}
 		}
 
+		if err := gw.transmitPending(); err != nil {
+			return err
+		}
+
 		if err := gw.await(); err != nil {
 			return err
 		}
+
+		gw.timeoutCount = 0
+	}
+}
+
+func (gw *ProtonGateway) Name() string {
+	return gw.name
+}
+
+// identify reads the mac address and firmware version of the connected
+// gateway. A failure to read the version is not fatal, the version read
+// before from the same gateway is kept.
+func (gw *ProtonGateway) identify(ctx context.Context) error {
+	mac, err := gw.readMac()
+	if err != nil {
+		return err
+	}
+
+	version, err := gw.readVersion()
+	if err != nil {
+		gw.log.Warnf("error reading firmware version: %v", err)
+		version = unknownVersion
+		gw.stateLock.Lock()
+		if gw.mac == mac && gw.version != "" {
+			version = gw.version
+		}
+		gw.stateLock.Unlock()
+		if err := gw.ensureSynchronized(ctx); err != nil {
+			return err
+		}
 	}
+
+	gw.stateLock.Lock()
+	previous := gw.mac
+	changed := previous != mac || gw.version != version
+	gw.mac = mac
+	gw.version = version
+	gw.stateLock.Unlock()
+
+	if previous != "" && previous != mac {
+		gw.log.Warnf("gateway mac address changed from %s to %s", previous, mac)
+	}
+	if changed {
+		gw.log.Infof("gateway %s running firmware %s", mac, version)
+	}
+	return nil
 }
 
-func (gw ProtonGateway) receivePacket() (packet.Packet, error) {
+// Mac returns the mac address of the gateway, or an empty string until it
+// has been connected.
+func (gw *ProtonGateway) Mac() string {
+	gw.stateLock.Lock()
+	defer gw.stateLock.Unlock()
+
+	return gw.mac
+}
+
+func (gw *ProtonGateway) Version() string {
+	gw.stateLock.Lock()
+	defer gw.stateLock.Unlock()
+
+	return gw.version
+}
+
+func (gw *ProtonGateway) Stats() Stats {
+	return gw.stats.snapshot(gw.State())
+}
+
+func (gw *ProtonGateway) State() State {
+	gw.stateLock.Lock()
+	defer gw.stateLock.Unlock()
+
+	return gw.state
+}
+
+func (gw *ProtonGateway) OnStateChange(handler StateHandler) {
+	gw.stateLock.Lock()
+	defer gw.stateLock.Unlock()
+
+	gw.stateHandler = handler
+}
+
+func (gw *ProtonGateway) setState(state State) {
+	gw.stateLock.Lock()
+	changed := gw.state != state
+	gw.state = state
+	handler := gw.stateHandler
+	gw.stateLock.Unlock()
+
+	if !changed {
+		return
+	}
+
+	gw.log.Infof("gateway state changed to %s", state)
+	if handler != nil {
+		handler(state)
+	}
+}
+
+// Send queues payload for transmission to mac. It blocks until the running
+// Start loop has handed the packet to the gateway, ctx is done or the packet
+// could not be sent in time. It fails right away while the gateway is not
+// connected.
+func (gw *ProtonGateway) Send(ctx context.Context, mac string, payload []byte) error {
+	address, err := utils.ParseMac(mac)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxPayloadLength {
+		return ErrPayloadTooLarge
+	}
+	if gw.State() != StateConnected {
+		return ErrNotConnected
+	}
+
+	timeout := time.NewTimer(gw.sendTimeout())
+	defer timeout.Stop()
+
+	result := make(chan error, 1)
+	select {
+	case gw.outgoing <- outgoingPacket{mac: address, payload: payload, result: result}:
+	case <-timeout.C:
+		return ErrSendTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-timeout.C:
+		return ErrSendTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sendTimeout bounds Send. The poll loop only transmits after the current
+// await returned, then it synchronizes and sends the packet.
+func (gw *ProtonGateway) sendTimeout() time.Duration {
+	return gw.timeouts[CmdAwait] + gw.timeouts[CmdSynchronize] + gw.timeouts[CmdSend] + sendMargin
+}
+
+func (gw *ProtonGateway) transmitPending() error {
+	for {
+		select {
+		case out := <-gw.outgoing:
+			err := gw.transmit(out.mac, out.payload)
+			out.result <- err
+			if err != nil && err != ErrSendRejected {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+func (gw *ProtonGateway) transmit(mac []byte, payload []byte) error {
+	if err := gw.synchronize(); err != nil {
+		return err
+	}
+
+	frame := make([]byte, 0, len(mac)+1+len(payload))
+	frame = append(frame, mac...)
+	frame = append(frame, uint8(len(payload)))
+	frame = append(frame, payload...)
+
+	var status uint8
+	exchange := func() error {
+		if _, err := gw.port.Write(frame); err != nil {
+			return err
+		}
+		return binary.Read(gw.port, binary.LittleEndian, &status)
+	}
+	if err := gw.execute(CmdSend, exchange); err != nil {
+		return err
+	}
+
+	if status != 0x00 {
+		return ErrSendRejected
+	}
+
+	return nil
+}
+
+func (gw *ProtonGateway) receivePacket() (packet.Packet, error) {
 	if err := gw.synchronize(); err != nil {
 		return nil, err
 	}
@@ -108,7 +464,7 @@ func (gw ProtonGateway) receivePacket() (packet.Packet, error) {
 	var result packet.Packet
 	reader := func() error {
 		var err error
-		result, err = packet.Read(gw.port)
+		result, err = packet.Read(gw.port, gw.framing)
 		return err
 	}
 
@@ -119,7 +475,7 @@ func (gw ProtonGateway) receivePacket() (packet.Packet, error) {
 	return result, nil
 }
 
-func (gw ProtonGateway) mac() (string, error) {
+func (gw *ProtonGateway) readMac() (string, error) {
 	if err := gw.synchronize(); err != nil {
 		return "", err
 	}
@@ -130,11 +486,37 @@ func (gw ProtonGateway) mac() (string, error) {
 		mac, err = utils.ReadMac(gw.port)
 		return err
 	}
-	err := gw.execute(CmdReadMac, reader)
-	return *mac, err
+	if err := gw.execute(CmdReadMac, reader); err != nil {
+		return "", err
+	}
+
+	return *mac, nil
+}
+
+func (gw *ProtonGateway) readVersion() (string, error) {
+	if err := gw.synchronize(); err != nil {
+		return "", err
+	}
+
+	var version []byte
+	reader := func() error {
+		var length uint8
+		if err := binary.Read(gw.port, binary.LittleEndian, &length); err != nil {
+			return err
+		}
+
+		version = make([]byte, length)
+		_, err := io.ReadFull(gw.port, version)
+		return err
+	}
+	if err := gw.execute(CmdReadVersion, reader); err != nil {
+		return "", err
+	}
+
+	return string(version), nil
 }
 
-func (gw ProtonGateway) await() error {
+func (gw *ProtonGateway) await() error {
 	if err := gw.synchronize(); err != nil {
 		return err
 	}
@@ -158,7 +540,7 @@ func (gw ProtonGateway) await() error {
 	return nil
 }
 
-func (gw ProtonGateway) messageCount() (int, error) {
+func (gw *ProtonGateway) messageCount() (int, error) {
 	if err := gw.synchronize(); err != nil {
 		return 0, err
 	}
@@ -170,60 +552,89 @@ func (gw ProtonGateway) messageCount() (int, error) {
 	if err := gw.execute(CmdMessageCount, reader); err != nil {
 		return 0, err
 	}
+	gw.stats.queue(int(messageCount))
 
 	return int(messageCount), nil
 }
 
-func (gw ProtonGateway) ensureConnected() error {
+func (gw *ProtonGateway) ensureConnected(ctx context.Context) error {
+	gw.setState(StateReconnecting)
+
 	var err error
-	for i := 0; i < maxReconnectAttempts; i++ {
-		err = gw.reconnect()
+	delay := minReconnectDelay
+	for i := 0; gw.maxReconnects == 0 || i < gw.maxReconnects; i++ {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 
+		err = gw.reconnect(ctx)
+		if ctx.Err() != nil {
+			// the port may have been opened just before
+			_ = gw.Close()
+			return ctx.Err()
+		}
 		if err == nil {
 			return nil
+		} else if gw.maxReconnects == 0 {
+			gw.log.Errorf("gateway not connected: %v. Attempt %d", err, i+1)
 		} else {
-			log.Errorf("gateway not connected. Attempt %d/%d", i, maxReconnectAttempts)
+			gw.log.Errorf("gateway not connected: %v. Attempt %d/%d", err, i+1, gw.maxReconnects)
+		}
+
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
 		}
 	}
 
 	return err
 }
 
-func (gw ProtonGateway) reconnect() error {
-	if gw.port != nil {
-		_ = gw.port.Close()
+func (gw *ProtonGateway) reconnect(ctx context.Context) error {
+	if err := gw.Close(); err != nil {
+		gw.log.Warnf("error closing gateway port: %v", err)
 	}
 
-	com, err := serial.OpenPort(gw.config)
-	gw.port = com
-
+	com, err := transport.Open(gw.address, gw.baudRate)
 	if err != nil {
 		return err
 	}
+	gw.portLock.Lock()
+	gw.port = com
+	gw.portLock.Unlock()
 
-	return gw.ensureSynchronized()
+	return gw.ensureSynchronized(ctx)
 }
 
-func (gw ProtonGateway) ensureSynchronized() error {
+// ensureSynchronized synchronizes with backoff. Waiting for the next attempt
+// ends early once ctx is done.
+func (gw *ProtonGateway) ensureSynchronized(ctx context.Context) error {
 	var err error
 	for i := 0; i < maxSyncAttempts; i++ {
 		err = gw.synchronize()
 		if err == nil {
 			return nil
 		}
-		if err != ErrOutOfSync {
-			log.Errorf("error synchronizing gateway: %v", err)
+		if err != ErrOutOfSync && err != ErrComTimeout {
+			gw.log.Errorf("error synchronizing gateway: %v", err)
 			return err
 		} else {
-			log.Errorf("gateway not in sync. Attempt %d/%d", i, maxSyncAttempts)
+			gw.stats.resync()
+			gw.log.Errorf("gateway not in sync. Attempt %d/%d", i, maxSyncAttempts)
+		}
+		select {
+		case <-time.After(syncDelay):
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		time.Sleep(syncDelay)
 	}
 
 	return err
 }
 
-func (gw ProtonGateway) synchronize() error {
+func (gw *ProtonGateway) synchronize() error {
 	if err := gw.port.Flush(); err != nil {
 		return err
 	}
@@ -243,10 +654,21 @@ func (gw ProtonGateway) synchronize() error {
 	return nil
 }
 
-func (gw ProtonGateway) execute(cmd Cmd, read func() error) error {
+func (gw *ProtonGateway) execute(cmd Cmd, read func() error) error {
+	if err := gw.port.SetReadDeadline(time.Now().Add(gw.timeouts[cmd])); err != nil {
+		return err
+	}
+
 	if err := binary.Write(gw.port, binary.LittleEndian, cmd); err != nil {
 		return err
 	}
 
-	return read()
+	if err := read(); err != nil {
+		if isTimeout(err) {
+			return ErrComTimeout
+		}
+		return err
+	}
+
+	return nil
 }
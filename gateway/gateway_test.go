@@ -0,0 +1,486 @@
+package gateway
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"proton-gateway/packet"
+	"proton-gateway/transport"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fakePort answers commands like an idle gateway. Commands listed in
+// timingOut get no reply, so reading their response runs into the deadline.
+// Queued frames are reported by CmdMessageCount and handed out by CmdRead.
+type fakePort struct {
+	lock      sync.Mutex
+	timingOut map[Cmd]bool
+	pending   []byte
+	frames    [][]byte
+	commands  map[Cmd]int
+	closed    bool
+}
+
+func newFakePort(timingOut ...Cmd) *fakePort {
+	port := &fakePort{
+		timingOut: make(map[Cmd]bool),
+		commands:  make(map[Cmd]int),
+	}
+	for _, cmd := range timingOut {
+		port.timingOut[cmd] = true
+	}
+
+	return port
+}
+
+func (port *fakePort) Write(p []byte) (int, error) {
+	port.lock.Lock()
+	defer port.lock.Unlock()
+
+	if port.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	for _, b := range p {
+		cmd := Cmd(b)
+		port.commands[cmd]++
+		if port.timingOut[cmd] {
+			continue
+		}
+
+		switch cmd {
+		case CmdSynchronize:
+			port.pending = binary.BigEndian.AppendUint32(port.pending, syncMagic)
+		case CmdReadMac:
+			port.pending = append(port.pending, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06)
+		case CmdReadVersion:
+			port.pending = append(port.pending, 4, 't', 'e', 's', 't')
+		case CmdMessageCount:
+			port.pending = append(port.pending, uint8(len(port.frames)))
+		case CmdAwait:
+			port.pending = append(port.pending, 0x00)
+		case CmdRead:
+			if len(port.frames) > 0 {
+				port.pending = append(port.pending, port.frames[0]...)
+				port.frames = port.frames[1:]
+			}
+		}
+	}
+
+	return len(p), nil
+}
+
+func (port *fakePort) Read(p []byte) (int, error) {
+	port.lock.Lock()
+	defer port.lock.Unlock()
+
+	if port.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(port.pending) == 0 {
+		return 0, fmt.Errorf("read fake: %w", os.ErrDeadlineExceeded)
+	}
+
+	n := copy(p, port.pending)
+	port.pending = port.pending[n:]
+	return n, nil
+}
+
+func (port *fakePort) Flush() error {
+	port.lock.Lock()
+	defer port.lock.Unlock()
+
+	port.pending = nil
+	return nil
+}
+
+func (port *fakePort) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (port *fakePort) Close() error {
+	port.lock.Lock()
+	defer port.lock.Unlock()
+
+	port.closed = true
+	return nil
+}
+
+func (port *fakePort) count(cmd Cmd) int {
+	port.lock.Lock()
+	defer port.lock.Unlock()
+
+	return port.commands[cmd]
+}
+
+func (port *fakePort) isClosed() bool {
+	port.lock.Lock()
+	defer port.lock.Unlock()
+
+	return port.closed
+}
+
+var errNoPort = errors.New("fake: no such port")
+
+// fakeOpener hands out fresh ports for the fake:// scheme and counts how
+// often the gateway reopened its port. The first failing opens report a
+// missing port.
+type fakeOpener struct {
+	lock    sync.Mutex
+	opened  []*fakePort
+	onOpen  func()
+	failing int
+	failed  int
+}
+
+var opener = &fakeOpener{}
+
+func (o *fakeOpener) open(string, int) (transport.Transport, error) {
+	o.lock.Lock()
+	if o.failed < o.failing {
+		o.failed++
+		o.lock.Unlock()
+		return nil, errNoPort
+	}
+	port := newFakePort()
+	o.opened = append(o.opened, port)
+	onOpen := o.onOpen
+	o.lock.Unlock()
+
+	if onOpen != nil {
+		onOpen()
+	}
+
+	return port, nil
+}
+
+func (o *fakeOpener) reset(onOpen func()) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.opened = nil
+	o.onOpen = onOpen
+	o.failing = 0
+	o.failed = 0
+}
+
+func (o *fakeOpener) fail(opens int) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.failing = opens
+}
+
+func (o *fakeOpener) count() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	return len(o.opened)
+}
+
+func init() {
+	transport.RegisterScheme("fake", opener.open)
+	syncDelay = time.Millisecond
+	minReconnectDelay = time.Millisecond
+	sendMargin = 10 * time.Millisecond
+	log.SetOutput(io.Discard)
+}
+
+func newTestGateway(port *fakePort, policy TimeoutPolicy, maxTimeouts int) *ProtonGateway {
+	timeouts := make(map[Cmd]time.Duration)
+	for _, cmd := range []Cmd{CmdSynchronize, CmdAwait, CmdRead, CmdMessageCount, CmdReadMac, CmdSend, CmdReadVersion} {
+		timeouts[cmd] = time.Millisecond
+	}
+
+	return &ProtonGateway{
+		name:          "test",
+		log:           log.WithField("gateway", "test"),
+		mac:           "010203040506",
+		address:       "fake://test",
+		port:          port,
+		outgoing:      make(chan outgoingPacket),
+		timeouts:      timeouts,
+		timeoutPolicy: policy,
+		maxTimeouts:   maxTimeouts,
+		state:         StateConnecting,
+	}
+}
+
+func TestExecuteMapsDeadlineToComTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		read error
+		want error
+	}{
+		{"success", nil, nil},
+		{"deadline", os.ErrDeadlineExceeded, ErrComTimeout},
+		{"wrapped deadline", fmt.Errorf("read tcp: %w", os.ErrDeadlineExceeded), ErrComTimeout},
+		{"other error", io.ErrUnexpectedEOF, io.ErrUnexpectedEOF},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gw := newTestGateway(newFakePort(), TimeoutPolicyResync, 3)
+
+			err := gw.execute(CmdRead, func() error {
+				return test.read
+			})
+			if !errors.Is(err, test.want) || (test.want == nil && err != nil) {
+				t.Errorf("execute() = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestStartTimeoutPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      TimeoutPolicy
+		maxTimeouts int
+		// timeouts on the first port before Start gives it up
+		wantTimeouts  int
+		wantResyncs   uint64
+		wantReconnect bool
+	}{
+		{"resync within limit", TimeoutPolicyResync, 3, 4, 3, true},
+		{"resync without retries", TimeoutPolicyResync, 0, 1, 0, true},
+		{"reconnect", TimeoutPolicyReconnect, 3, 1, 0, true},
+		{"fail", TimeoutPolicyFail, 3, 1, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			// stop once the gateway reconnected
+			opener.reset(cancel)
+
+			port := newFakePort(CmdMessageCount)
+			gw := newTestGateway(port, test.policy, test.maxTimeouts)
+
+			err := gw.Start(ctx, func(packet.Packet) {})
+
+			if test.wantReconnect {
+				if err != context.Canceled {
+					t.Errorf("Start() = %v, want %v", err, context.Canceled)
+				}
+				if opener.count() != 1 {
+					t.Errorf("port opened %d times, want 1", opener.count())
+				}
+			} else {
+				if err != ErrComTimeout {
+					t.Errorf("Start() = %v, want %v", err, ErrComTimeout)
+				}
+				if opener.count() != 0 {
+					t.Errorf("port opened %d times, want 0", opener.count())
+				}
+			}
+
+			if timeouts := port.count(CmdMessageCount); timeouts != test.wantTimeouts {
+				t.Errorf("%d timeouts before giving up the port, want %d", timeouts, test.wantTimeouts)
+			}
+			if resyncs := gw.Stats().Resyncs; resyncs != test.wantResyncs {
+				t.Errorf("%d resyncs, want %d", resyncs, test.wantResyncs)
+			}
+		})
+	}
+}
+
+func TestReconnectReopensPort(t *testing.T) {
+	opener.reset(nil)
+
+	old := newFakePort()
+	gw := newTestGateway(old, TimeoutPolicyResync, 3)
+
+	if err := gw.reconnect(context.Background()); err != nil {
+		t.Fatalf("reconnect() = %v", err)
+	}
+
+	if !old.isClosed() {
+		t.Errorf("old port not closed")
+	}
+	if opener.count() != 1 {
+		t.Fatalf("port opened %d times, want 1", opener.count())
+	}
+	if gw.port != opener.opened[0] {
+		t.Errorf("gateway does not use the reopened port")
+	}
+	if opener.opened[0].count(CmdSynchronize) == 0 {
+		t.Errorf("reopened port not synchronized")
+	}
+}
+
+func TestStartConnectsMissingGateway(t *testing.T) {
+	tests := []struct {
+		name          string
+		failing       int
+		maxReconnects int
+		wantErr       error
+		wantMac       string
+	}{
+		{"connects once available", 3, 0, context.Canceled, "010203040506"},
+		{"gives up after max_reconnects", 5, 2, errNoPort, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			opener.reset(nil)
+			opener.fail(test.failing)
+
+			gw := newTestGateway(nil, TimeoutPolicyResync, 3)
+			gw.port = nil
+			gw.mac = ""
+			gw.maxReconnects = test.maxReconnects
+			gw.OnStateChange(func(state State) {
+				if state == StateConnected {
+					cancel()
+				}
+			})
+
+			err := gw.Start(ctx, func(packet.Packet) {})
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("Start() = %v, want %v", err, test.wantErr)
+			}
+			if mac := gw.Mac(); mac != test.wantMac {
+				t.Errorf("Mac() = %q, want %q", mac, test.wantMac)
+			}
+		})
+	}
+}
+
+func TestStartDropsCorruptFrames(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opener.reset(nil)
+
+	valid := []byte{0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 1, 0x42}
+	valid = append(valid, packet.ChecksumCrc8.Sum(valid)...)
+	corrupt := append([]byte(nil), valid...)
+	corrupt[7] ^= 0x10
+
+	port := newFakePort()
+	port.frames = [][]byte{corrupt, valid}
+	gw := newTestGateway(port, TimeoutPolicyResync, 3)
+	gw.framing = packet.Options{Gateway: "test", Checksum: packet.ChecksumCrc8}
+
+	var received []packet.Packet
+	err := gw.Start(ctx, func(p packet.Packet) {
+		received = append(received, p)
+		cancel()
+	})
+	if err != context.Canceled {
+		t.Errorf("Start() = %v, want %v", err, context.Canceled)
+	}
+
+	if len(received) != 1 || received[0].Payload()[0] != 0x42 {
+		t.Errorf("received %v, want the valid frame only", received)
+	}
+	stats := gw.Stats()
+	if stats.Dropped != 1 {
+		t.Errorf("%d dropped frames, want 1", stats.Dropped)
+	}
+	if stats.Packets != 1 {
+		t.Errorf("%d packets, want 1", stats.Packets)
+	}
+}
+
+func TestSendFailsWithoutPolling(t *testing.T) {
+	tests := []struct {
+		name  string
+		state State
+		want  error
+	}{
+		{"disconnected", StateDisconnected, ErrNotConnected},
+		{"reconnecting", StateReconnecting, ErrNotConnected},
+		{"connected but not polled", StateConnected, ErrSendTimeout},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gw := newTestGateway(newFakePort(), TimeoutPolicyResync, 3)
+			gw.state = test.state
+
+			err := gw.Send(context.Background(), "010203040506", []byte{0x01})
+			if err != test.want {
+				t.Errorf("Send() = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestIdentifyKeepsVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		mac     string
+		version string
+		want    string
+	}{
+		{"never read", "", "", unknownVersion},
+		{"read before", "010203040506", "1.2", "1.2"},
+		{"read from another gateway", "0a0b0c0d0e0f", "1.2", unknownVersion},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gw := newTestGateway(newFakePort(CmdReadVersion), TimeoutPolicyResync, 3)
+			gw.mac = test.mac
+			gw.version = test.version
+
+			if err := gw.identify(context.Background()); err != nil {
+				t.Fatalf("identify() = %v", err)
+			}
+			if version := gw.Version(); version != test.want {
+				t.Errorf("Version() = %q, want %q", version, test.want)
+			}
+		})
+	}
+}
+
+func TestEnsureConnectedClosesPortOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// cancel while the port is opened, before ensureConnected checks ctx
+	opener.reset(cancel)
+
+	gw := newTestGateway(nil, TimeoutPolicyResync, 3)
+	gw.port = nil
+
+	if err := gw.ensureConnected(ctx); err != context.Canceled {
+		t.Errorf("ensureConnected() = %v, want %v", err, context.Canceled)
+	}
+	if opener.count() != 1 {
+		t.Fatalf("port opened %d times, want 1", opener.count())
+	}
+	if !opener.opened[0].isClosed() || gw.connected() {
+		t.Errorf("port opened before the cancellation left open")
+	}
+}
+
+func TestEnsureSynchronizedStopsOnCancel(t *testing.T) {
+	defer func(delay time.Duration) {
+		syncDelay = delay
+	}(syncDelay)
+	syncDelay = time.Minute
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	gw := newTestGateway(newFakePort(CmdSynchronize), TimeoutPolicyResync, 3)
+
+	started := time.Now()
+	if err := gw.ensureSynchronized(ctx); err != context.DeadlineExceeded {
+		t.Errorf("ensureSynchronized() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("ensureSynchronized() returned after %s, want right after ctx is done", elapsed)
+	}
+}
@@ -0,0 +1,122 @@
+package gateway
+
+import (
+	"fmt"
+	"proton-gateway/homeassistant"
+	"proton-gateway/message"
+	"proton-gateway/topic"
+)
+
+func StateTopic(layout *topic.Layout, name string) string {
+	return layout.Join("gateway-"+name, "state")
+}
+
+func DiagnosticsTopic(layout *topic.Layout, name string) string {
+	return layout.Join("gateway-"+name, "diagnostics")
+}
+
+// Topics returns the topics of the gateway named name, for checking them
+// against the topics of the devices.
+func Topics(layout *topic.Layout, name string) topic.Topics {
+	return topic.Topics{
+		Owner:  "gateway " + name,
+		Topics: []string{StateTopic(layout, name), DiagnosticsTopic(layout, name)},
+	}
+}
+
+// DeviceId identifies the gateway in Home Assistant. Devices reached through
+// it reference this id as their via_device. It is empty while the gateway
+// has not been connected yet.
+func DeviceId(gw Gateway) string {
+	if gw.Mac() == "" {
+		return ""
+	}
+	return fmt.Sprintf("protongw-%s", gw.Mac())
+}
+
+// Configuration announces the gateway and its diagnostic sensors to Home
+// Assistant.
+func Configuration(layout *topic.Layout, gw Gateway) []message.Message {
+	return []message.Message{
+		connectionStateConfig(layout, gw),
+		diagnosticConfig(layout, gw, "resyncs", "Resynchronizations", "total_increasing", ""),
+		diagnosticConfig(layout, gw, "packets_per_minute", "Packets per Minute", "measurement", "packets/min"),
+		diagnosticConfig(layout, gw, "queue_depth", "Queue Depth", "measurement", "packets"),
+		diagnosticConfig(layout, gw, "dropped", "Dropped Frames", "total_increasing", "packets"),
+		diagnosticConfig(layout, gw, "last_error", "Last Error", "", ""),
+	}
+}
+
+// Diagnostics returns the current gateway statistics for DiagnosticsTopic.
+func Diagnostics(layout *topic.Layout, gw Gateway) (message.Message, error) {
+	stats := gw.Stats()
+	return message.Json(DiagnosticsTopic(layout, gw.Name()), &stats, true, 0)
+}
+
+func topicDevice(gw Gateway) topic.Device {
+	return topic.Device{Mac: gw.Mac(), Type: "gateway", Name: gw.Name(), Id: DeviceId(gw)}
+}
+
+func deviceConfig(gw Gateway) *homeassistant.DeviceConfig {
+	conf := homeassistant.NewDeviceConfig()
+	conf.AddIdentifier(DeviceId(gw))
+	conf.AddConnection("mac", gw.Mac())
+	conf.SetManufacturer("proton")
+	conf.SetModel("gateway")
+	conf.SetName(fmt.Sprintf("Proton Gateway %s", gw.Name()))
+	conf.SetSoftwareVersion(gw.Version())
+
+	return conf
+}
+
+func entityConfig(layout *topic.Layout, gw Gateway, entity string) *homeassistant.EntityConfig {
+	conf := homeassistant.NewEntityConfig()
+	conf.AddAvailability(homeassistant.BridgeStatusTopic(layout), "online", "offline")
+	conf.SetObjectId(fmt.Sprintf("%s_%s", DeviceId(gw), entity))
+	conf.SetUniqueId(fmt.Sprintf("%s_%s", DeviceId(gw), entity))
+	conf.Device = deviceConfig(gw)
+
+	return conf
+}
+
+func connectionStateConfig(layout *topic.Layout, gw Gateway) message.Message {
+	conf := homeassistant.NewSensorConfig(entityConfig(layout, gw, "connection_state"))
+
+	conf.SetName("Connection State")
+	conf.SetEntityCategory("diagnostic")
+	conf.SetStateTopic(StateTopic(layout, gw.Name()))
+
+	return configToMessage(
+		homeassistant.AutoDiscoveryTopic(layout, homeassistant.EntityTypeSensor, topicDevice(gw), "connection_state"),
+		&conf,
+	)
+}
+
+func diagnosticConfig(layout *topic.Layout, gw Gateway, field string, name string, stateClass string, unit string) message.Message {
+	conf := homeassistant.NewSensorConfig(entityConfig(layout, gw, field))
+
+	conf.SetName(name)
+	conf.SetValueTemplate(fmt.Sprintf("{{ value_json.%s }}", field))
+	if stateClass != "" {
+		conf.SetStateClass(stateClass)
+	}
+	if unit != "" {
+		conf.SetUnitOfMeasurement(unit)
+	}
+	conf.SetEntityCategory("diagnostic")
+	conf.SetStateTopic(DiagnosticsTopic(layout, gw.Name()))
+
+	return configToMessage(
+		homeassistant.AutoDiscoveryTopic(layout, homeassistant.EntityTypeSensor, topicDevice(gw), field),
+		&conf,
+	)
+}
+
+func configToMessage(topic string, config interface{}) message.Message {
+	msg, err := message.Json(topic, config, true, 0)
+	if err != nil {
+		panic(err)
+	}
+
+	return msg
+}
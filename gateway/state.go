@@ -0,0 +1,13 @@
+package gateway
+
+type State string
+
+const (
+	StateConnecting    State = "connecting"
+	StateSynchronizing State = "synchronizing"
+	StateConnected     State = "connected"
+	StateReconnecting  State = "reconnecting"
+	StateDisconnected  State = "disconnected"
+)
+
+type StateHandler func(State)
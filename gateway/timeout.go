@@ -0,0 +1,57 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"proton-gateway/config"
+	"time"
+)
+
+// TimeoutPolicy decides how Start reacts to a command timing out.
+type TimeoutPolicy string
+
+const (
+	// TimeoutPolicyResync resynchronizes and keeps polling. After too many
+	// consecutive timeouts the port is reconnected instead.
+	TimeoutPolicyResync TimeoutPolicy = "resync"
+	// TimeoutPolicyReconnect treats every timeout as a lost connection.
+	TimeoutPolicyReconnect TimeoutPolicy = "reconnect"
+	// TimeoutPolicyFail makes Start return the timeout.
+	TimeoutPolicyFail TimeoutPolicy = "fail"
+)
+
+var ErrUnknownPolicy = errors.New("gateway: unknown timeout policy")
+
+func parseTimeoutPolicy(policy string) (TimeoutPolicy, error) {
+	switch TimeoutPolicy(policy) {
+	case TimeoutPolicyResync, TimeoutPolicyReconnect, TimeoutPolicyFail:
+		return TimeoutPolicy(policy), nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnknownPolicy, policy)
+	}
+}
+
+func commandTimeouts(conf config.TimeoutConfig) map[Cmd]time.Duration {
+	timeouts := map[Cmd]time.Duration{
+		CmdSynchronize:  conf.Synchronize,
+		CmdMessageCount: conf.MessageCount,
+		CmdRead:         conf.Read,
+		CmdReadMac:      conf.ReadMac,
+		CmdReadVersion:  conf.ReadVersion,
+		CmdSend:         conf.Send,
+		CmdAwait:        conf.Await,
+	}
+
+	for cmd, timeout := range timeouts {
+		if timeout == 0 {
+			timeouts[cmd] = conf.Default
+		}
+	}
+
+	return timeouts
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -7,6 +7,7 @@ require (
 	github.com/eclipse/paho.mqtt.golang v1.4.2
 	github.com/sirupsen/logrus v1.9.0
 	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
+	go.starlark.net v0.0.0-20231121155337-90ade8b19d09
 	gopkg.in/yaml.v2 v2.4.0
 )
 
@@ -0,0 +1,40 @@
+package homeassistant
+
+type BinarySensorConfig struct {
+	EntityConfig
+
+	DeviceClass   *string `json:"device_class,omitempty"`
+	ExpireAfter   *int    `json:"expire_after,omitempty"`
+	ForceUpdate   *bool   `json:"force_update,omitempty"`
+	OffDelay      *int    `json:"off_delay,omitempty"`
+	PayloadOff    *string `json:"payload_off,omitempty"`
+	PayloadOn     *string `json:"payload_on,omitempty"`
+	StateTopic    *string `json:"state_topic,omitempty"`
+	ValueTemplate *string `json:"value_template,omitempty"`
+}
+
+func NewBinarySensorConfig(config *EntityConfig) *BinarySensorConfig {
+	return &BinarySensorConfig{
+		EntityConfig: *config,
+	}
+}
+
+func (conf *BinarySensorConfig) SetDeviceClass(class string) {
+	conf.DeviceClass = &class
+}
+
+func (conf *BinarySensorConfig) SetExpireAfter(seconds int) {
+	conf.ExpireAfter = &seconds
+}
+
+func (conf *BinarySensorConfig) SetValueTemplate(template string) {
+	conf.ValueTemplate = &template
+}
+
+func (conf *BinarySensorConfig) SetEntityCategory(category string) {
+	conf.EntityCategory = &category
+}
+
+func (conf *BinarySensorConfig) SetStateTopic(topic string) {
+	conf.StateTopic = &topic
+}
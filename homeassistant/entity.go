@@ -1,23 +1,32 @@
 package homeassistant
 
+import "proton-gateway/topic"
+
+// BridgeStatusTopic carries the availability of the bridge itself. It is
+// published retained as "online" on connect and set to "offline" by the
+// broker through the last will.
+func BridgeStatusTopic(layout *topic.Layout) string {
+	return layout.Join("bridge", "status")
+}
+
 type EntityConfig struct {
-	Availability           *AvailabilityConfig `json:"availability,omitempty"`
-	AvailabilityMode       *AvailabilityMode   `json:"availability_mode,omitempty"`
-	AvailabilityTemplate   *string             `json:"availability_template,omitempty"`
-	AvailabilityTopic      *string             `json:"availability_topic,omitempty"`
-	Device                 *DeviceConfig       `json:"device,omitempty"`
-	EnabledByDefault       *bool               `json:"enabled_by_default,omitempty"`
-	Encoding               *string             `json:"encoding,omitempty"`
-	EntityCategory         *string             `json:"entity_category,omitempty"`
-	JsonAttributesTemplate *string             `json:"json_attributes_template,omitempty"`
-	JsonAttributesTopic    *string             `json:"json_attributes_topic,omitempty"`
-	Name                   *string             `json:"name,omitempty"`
-	ObjectId               *string             `json:"object_id,omitempty"`
-	Qos                    *int8               `json:"qos,omitempty"`
-	UniqueId               *string             `json:"unique_id,omitempty"`
-	Icon                   *string             `json:"icon,omitempty"`
-	PayloadAvailable       *string             `json:"payload_available,omitempty"`
-	PayloadNotAvailable    *string             `json:"payload_not_available,omitempty"`
+	Availability           []AvailabilityConfig `json:"availability,omitempty"`
+	AvailabilityMode       *AvailabilityMode    `json:"availability_mode,omitempty"`
+	AvailabilityTemplate   *string              `json:"availability_template,omitempty"`
+	AvailabilityTopic      *string              `json:"availability_topic,omitempty"`
+	Device                 *DeviceConfig        `json:"device,omitempty"`
+	EnabledByDefault       *bool                `json:"enabled_by_default,omitempty"`
+	Encoding               *string              `json:"encoding,omitempty"`
+	EntityCategory         *string              `json:"entity_category,omitempty"`
+	JsonAttributesTemplate *string              `json:"json_attributes_template,omitempty"`
+	JsonAttributesTopic    *string              `json:"json_attributes_topic,omitempty"`
+	Name                   *string              `json:"name,omitempty"`
+	ObjectId               *string              `json:"object_id,omitempty"`
+	Qos                    *int8                `json:"qos,omitempty"`
+	UniqueId               *string              `json:"unique_id,omitempty"`
+	Icon                   *string              `json:"icon,omitempty"`
+	PayloadAvailable       *string              `json:"payload_available,omitempty"`
+	PayloadNotAvailable    *string              `json:"payload_not_available,omitempty"`
 }
 
 func NewEntityConfig() *EntityConfig {
@@ -28,6 +37,19 @@ func (conf *EntityConfig) SetAvailabilityTopic(topic string) {
 	conf.AvailabilityTopic = &topic
 }
 
+// AddAvailability adds a topic to the availability list of the entity.
+func (conf *EntityConfig) AddAvailability(topic string, available string, notAvailable string) {
+	conf.Availability = append(conf.Availability, AvailabilityConfig{
+		PayloadAvailable:    &available,
+		PayloadNotAvailable: &notAvailable,
+		Topic:               topic,
+	})
+}
+
+func (conf *EntityConfig) SetAvailabilityMode(mode AvailabilityMode) {
+	conf.AvailabilityMode = &mode
+}
+
 func (conf *EntityConfig) SetName(name string) {
 	conf.Name = &name
 }
@@ -66,5 +88,6 @@ const (
 type EntityType string
 
 const (
-	EntityTypeSensor EntityType = "sensor"
+	EntityTypeSensor       EntityType = "sensor"
+	EntityTypeBinarySensor EntityType = "binary_sensor"
 )
@@ -1,7 +1,7 @@
 package homeassistant
 
-import "fmt"
+import "proton-gateway/topic"
 
-func AutoDiscoveryTopic(entityType EntityType, deviceId string, sensorName string) string {
-	return fmt.Sprintf("homeassistant/%s/%s/%s/config", entityType, deviceId, sensorName)
+func AutoDiscoveryTopic(layout *topic.Layout, entityType EntityType, device topic.Device, sensorName string) string {
+	return layout.Discovery(string(entityType), device, sensorName)
 }
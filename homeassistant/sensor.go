@@ -23,6 +23,10 @@ func (conf *SensorConfig) SetDeviceClass(class string) {
 	conf.DeviceClass = &class
 }
 
+func (conf *SensorConfig) SetExpireAfter(seconds int) {
+	conf.ExpireAfter = &seconds
+}
+
 func (conf *SensorConfig) SetValueTemplate(template string) {
 	conf.ValueTemplate = &template
 }
@@ -1,127 +1,359 @@
 package main
 
 import (
-	"bytes"
-	"fmt"
+	"context"
+	"flag"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	log "github.com/sirupsen/logrus"
 	"os"
+	"os/signal"
+	"proton-gateway/capture"
 	"proton-gateway/config"
+	"proton-gateway/dedup"
 	"proton-gateway/device"
+	"proton-gateway/discovery"
 	"proton-gateway/gateway"
 	"proton-gateway/message"
 	"proton-gateway/packet"
+	"proton-gateway/topic"
+	"proton-gateway/watchdog"
 	"sync"
+	"syscall"
 	"time"
 )
 
+// disconnectQuiesce is how long in-flight messages get to complete on disconnect.
+const disconnectQuiesce = 250 * time.Millisecond
+
+// pendingInterval limits how often the pending devices are published while
+// only their counts and samples change.
+const pendingInterval = 10 * time.Second
+
+// statsResolution is how often aggregators are checked for statistics due.
+const statsResolution = 100 * time.Millisecond
+
 func main() {
-	file, err := os.Open("config.yaml")
-	if err != nil {
-		log.Fatalf("error opening config.yaml: %v", err)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "simulate":
+			simulate(os.Args[2:])
+			return
+		case "replay":
+			replay(os.Args[2:])
+			return
+		case "purge":
+			purge(os.Args[2:])
+			return
+		}
 	}
-	log.Infof("configuration opened")
 
-	conf, err := config.Load(file)
-	if err != nil {
-		log.Fatalf("error loading configuration: %v", err)
+	configFile := flag.String("config", "config.yaml", "configuration file")
+	captureFile := flag.String("capture", "", "append every received packet to this capture file")
+	flag.Parse()
+
+	conf, layout := loadConfig(*configFile)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var recorder *capture.Writer
+	if *captureFile != "" {
+		var err error
+		recorder, err = capture.Create(*captureFile)
+		if err != nil {
+			log.Fatalf("error opening capture file: %v", err)
+		}
+		log.Infof("capturing packets to %s", *captureFile)
 	}
-	_ = file.Close()
-	log.Infof("configuration loaded")
 
-	devices := make(map[string]device.Device)
+	client := newRetainingClient(layout)
+	client.connect(conf.Mqtt)
+	subscribeBirth(client, conf.HomeAssistant)
 
-	log.Infof("creating new mqtt client")
-	options := mqtt.NewClientOptions()
-	options.SetAutoReconnect(true)
-	options.AddBroker(fmt.Sprintf("tcp://%s:%d", conf.Mqtt.Host, conf.Mqtt.Port))
-	client := mqtt.NewClient(options)
+	state := openStore(conf.State.Path)
+	owned := loadDiscovery(state)
+	manifest := newDiscoveryManifest(layout)
+	configured := make(map[string]bool)
 
-	log.Infof("connecting to mqtt server")
-	token := client.Connect()
-	token.Wait()
-	if token.Error() != nil {
-		log.Fatalf("error connecting to mqtt broker: %v", token.Error())
+	log.Infof("opening gateways")
+	gws := newGateways()
+	// gateways connected since the devices were announced
+	connected := make(chan gateway.Gateway, len(conf.Gateways))
+	for _, gatewayConfig := range conf.Gateways {
+		gw, err := gateway.OpenGateway(gatewayConfig)
+		if err != nil {
+			log.Fatalf("error opening connection to gateway %s: %v", gatewayConfig.Name, err)
+		}
+		configured[gatewayKey(gw.Name())] = true
+
+		stateTopic := gateway.StateTopic(layout, gw.Name())
+		announce := announceGateway(client, layout, state, manifest, gw)
+		gw.OnStateChange(func(gwState gateway.State) {
+			client.Publish(stateTopic, 0, true, []byte(gwState)).Wait()
+			if gwState == gateway.StateConnected && announce() {
+				select {
+				case connected <- gw:
+				default:
+				}
+			}
+		})
+		gws.add(gw)
+	}
+	if len(gws.all) == 0 {
+		log.Fatalf("no gateway configured")
 	}
-	log.Infof("connected to mqtt server")
 
-	log.Infof("building devices and announcing configuration")
 	for _, deviceConfig := range conf.Devices {
-		dev := device.GetDeviceByType(deviceConfig.Type)
-		if dev != nil {
-			devices[deviceConfig.Mac] = dev
-
-			log.Infof("announcing configuration for device: %s", deviceConfig.Mac)
-			for _, msg := range dev.Configuration(deviceConfig.Mac) {
-				client.Subscribe(msg.Topic(), msg.Qos(), func(client mqtt.Client, m mqtt.Message) {
-					if bytes.Compare(m.Payload(), msg.Payload()) != 0 {
-						client.Publish(msg.Topic(), msg.Qos(), msg.Retain(), msg.Payload()).Wait()
-					}
-				})
-				client.Publish(msg.Topic(), msg.Qos(), msg.Retain(), msg.Payload()).Wait()
-			}
-		} else {
-			log.Warnf("unknown device type %s. Packets for %s won't be handled", deviceConfig.Type, deviceConfig.Mac)
+		if deviceConfig.Gateway != "" {
+			gws.prefer(deviceConfig.Mac, deviceConfig.Gateway)
 		}
 	}
-	log.Infof("configuration announced")
 
-	log.Infof("opening gateway")
-	gw, err := gateway.OpenGateway(conf.Serial.Port, int(conf.Serial.BaudRate))
+	log.Infof("building devices and announcing configuration")
+	loadDefinitions(conf.Definitions)
+	loadAdopted(conf, state)
+	pl, err := buildPipeline(conf, layout, state)
 	if err != nil {
-		log.Fatalf("error opening connection to gateway: %v", err)
+		log.Fatalf("error loading configuration: %v", err)
+	}
+	for _, deviceConfig := range conf.Devices {
+		configured[deviceConfig.Mac] = true
+	}
+	for mac := range pl.devices {
+		announceDevice(client, manifest, mac, pl.configuration(mac, gateway.DeviceId(gws.route(mac))))
+	}
+	cleanupDiscovery(client, state, manifest, owned, configured)
+	log.Infof("configuration announced")
+	rememberStates(client, pl.devices)
+
+	for mac, dev := range pl.devices {
+		subscribeCommands(ctx, client, gws, mac, dev)
+	}
+
+	var disc *discovery.Discovery
+	var adoptions <-chan discovery.Adoption
+	if conf.Discovery.Enabled {
+		log.Infof("discovering unknown devices")
+		disc = discovery.New(conf.Discovery.Samples, layout)
+		adoptions = disc.Adoptions()
+		subscribeAdoptions(client, layout, disc)
+		// replaces devices which were pending before the restart
+		publishPending(client, disc)
+		if conf.Discovery.Listen != "" {
+			go serveDiscovery(ctx, conf.Discovery.Listen, disc)
+		}
 	}
 
 	packets := make(chan packet.Packet)
 	messages := make(chan message.Message)
 
+	deduplicator, err := dedup.New(conf.Deduplication.Strategy, conf.Deduplication.Window, func(p packet.Packet) {
+		packets <- p
+	})
+	if err != nil {
+		log.Fatalf("error configuring deduplication: %v", err)
+	}
+
+	watch := watchdog.New(func(msg message.Message) {
+		publish(client, msg)
+	}, state)
+	for _, deviceConfig := range conf.Devices {
+		if dev, found := pl.devices[deviceConfig.Mac]; found {
+			watch.Watch(deviceConfig.Mac, deviceConfig.Timeout, dev.Offline)
+		}
+	}
+	go watch.Run(ctx, conf.Availability.Interval)
+	go flushStore(ctx, state, conf.State.Flush)
+
+	for i, gw := range gws.all {
+		go publishDiagnostics(ctx, client, layout, gw, conf.Gateways[i].Diagnostics)
+	}
+
 	wg := sync.WaitGroup{}
+	wg.Add(3)
 
 	go func() {
-		wg.Add(1)
+		defer wg.Done()
+		defer close(packets)
 
-		log.Infof("starting gateway connection")
-		err := gw.Start(func(p packet.Packet) {
-			packets <- p
-		})
+		gatewaysWg := sync.WaitGroup{}
+		for _, gw := range gws.all {
+			gatewaysWg.Add(1)
+			go func(gw gateway.Gateway) {
+				defer gatewaysWg.Done()
+
+				log.Infof("starting gateway connection %s", gw.Name())
+				err := gw.Start(ctx, func(p packet.Packet) {
+					if recorder != nil {
+						if err := recorder.Write(p); err != nil {
+							log.Errorf("error capturing packet: %v", err)
+						}
+					}
+
+					gws.heard(p)
+					deduplicator.Add(p)
+				})
+
+				if ctx.Err() == nil {
+					log.Errorf("gateway %s encountered error: %v", gw.Name(), err)
+				}
+			}(gw)
+		}
 
-		log.Fatalf("gateway encountered error: %v", err)
+		gatewaysWg.Wait()
+		deduplicator.Close()
+		stop()
 	}()
 
 	go func() {
-		wg.Add(1)
+		defer wg.Done()
+		defer close(messages)
 
 		log.Infof("listening for incoming packets")
-		for p := range packets {
-			dev, found := devices[p.Mac()]
-			if !found {
-				log.Warnf("received packet from unknown device: %s", p.Mac())
-				continue
-			}
+		var pendingPublished time.Time
+		statsTicker := time.NewTicker(statsResolution)
+		defer statsTicker.Stop()
+		for {
+			select {
+			case now := <-statsTicker.C:
+				for _, msg := range pl.publishStats(now) {
+					messages <- msg
+				}
+			case p, ok := <-packets:
+				if !ok {
+					return
+				}
+
+				watch.Seen(p.Mac(), p.Timestamp())
+				if _, found := pl.devices[p.Mac()]; !found && disc != nil {
+					discovered := disc.Record(p)
+					if discovered {
+						log.Infof("discovered unknown device %s with %d bytes payload", p.Mac(), len(p.Payload()))
+					}
+					if discovered || time.Since(pendingPublished) >= pendingInterval {
+						publishPending(client, disc)
+						pendingPublished = time.Now()
+					}
+					continue
+				}
+
+				for _, msg := range pl.process(p) {
+					messages <- msg
+				}
+			case gw := <-connected:
+				announceRouted(client, state, manifest, pl, gws, gw)
+			case adoption := <-adoptions:
+				if _, found := pl.devices[adoption.Mac]; found {
+					log.Warnf("device %s is already handled", adoption.Mac)
+					continue
+				}
+
+				adopted := config.DeviceConfig{
+					Type: adoption.Type,
+					Mac:  adoption.Mac,
+					Name: adoption.Name,
+				}
+				if err := conf.CheckName(adopted); err != nil {
+					log.Errorf("error adopting device %s as %s: %v", adoption.Mac, adoption.Type, err)
+					continue
+				}
+				deviceConfig := adopted
+				conf.Inherit(&deviceConfig)
+				dev, err := buildDevice(deviceConfig, layout, state)
+				if err != nil {
+					log.Errorf("error adopting device %s as %s: %v", adoption.Mac, adoption.Type, err)
+					continue
+				}
+				pl.add(deviceConfig, dev)
+				if err := pl.checkTopics(); err != nil {
+					log.Errorf("error adopting device %s as %s: %v", adoption.Mac, adoption.Type, err)
+					pl.remove(adoption.Mac)
+					stopDevices(map[string]device.Device{adoption.Mac: dev})
+					continue
+				}
+
+				log.Infof("adopted device %s as %s", adoption.Mac, adoption.Type)
+				announceDevice(client, manifest, adoption.Mac, pl.configuration(adoption.Mac, gateway.DeviceId(gws.route(adoption.Mac))))
+				subscribeCommands(ctx, client, gws, adoption.Mac, dev)
+				watch.Watch(adoption.Mac, deviceConfig.Timeout, dev.Offline)
+				rememberAdopted(state, adopted)
+				// later adoptions must not take its name
+				conf.Devices = append(conf.Devices, deviceConfig)
+				rememberDiscovery(state, manifest)
 
-			for _, msg := range dev.Process(p) {
-				messages <- msg
+				disc.Remove(adoption.Mac)
+				publishPending(client, disc)
 			}
 		}
-
-		wg.Done()
 	}()
 
 	go func() {
-		wg.Add(1)
+		defer wg.Done()
 
 		log.Infof("starting message handler")
 		for msg := range messages {
-			client.Publish(msg.Topic(), msg.Qos(), msg.Retain(), msg.Payload()).Wait()
+			publish(client, msg)
 		}
-
-		wg.Done()
 	}()
 
-	time.Sleep(100 * time.Millisecond)
+	<-ctx.Done()
+	log.Infof("shutting down")
 	wg.Wait()
 
-	log.Errorf("finishing execution")
+	for _, dev := range pl.devices {
+		for _, msg := range dev.Offline() {
+			publish(client, msg)
+		}
+	}
+	stopDevices(pl.devices)
+	if err := state.Flush(); err != nil {
+		log.Errorf("error flushing state store: %v", err)
+	}
+
+	for _, gw := range gws.all {
+		if err := gw.Close(); err != nil {
+			log.Warnf("error closing gateway %s: %v", gw.Name(), err)
+		}
+	}
+	disconnectMqtt(client, layout)
+
+	if recorder != nil {
+		if err := recorder.Close(); err != nil {
+			log.Warnf("error closing capture file: %v", err)
+		}
+	}
+
+	log.Infof("finishing execution")
+}
+
+func publishPending(client mqtt.Client, disc *discovery.Discovery) {
+	msg, err := disc.Message()
+	if err != nil {
+		log.Errorf("error building pending devices: %v", err)
+		return
+	}
+
+	publish(client, msg)
+}
+
+func publishDiagnostics(ctx context.Context, client mqtt.Client, layout *topic.Layout, gw gateway.Gateway, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		msg, err := gateway.Diagnostics(layout, gw)
+		if err != nil {
+			log.Errorf("error building diagnostics for gateway %s: %v", gw.Name(), err)
+		} else {
+			publish(client, msg)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
 //ec94cb6bd6f00c
@@ -0,0 +1,96 @@
+package packet
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Checksum names the integrity trailer the gateway appends to a frame. It
+// covers every byte of the frame before it.
+type Checksum string
+
+const (
+	ChecksumNone Checksum = "none"
+	// ChecksumXor8 is a single byte XOR of the frame.
+	ChecksumXor8 Checksum = "xor8"
+	// ChecksumCrc8 is CRC-8/SMBUS (polynomial 0x07, init 0x00).
+	ChecksumCrc8 Checksum = "crc8"
+	// ChecksumCrc16 is CRC-16/CCITT-FALSE (polynomial 0x1021, init 0xffff),
+	// transmitted big endian.
+	ChecksumCrc16 Checksum = "crc16"
+)
+
+var ErrUnknownChecksum = errors.New("packet: unknown checksum")
+
+func ParseChecksum(name string) (Checksum, error) {
+	switch Checksum(name) {
+	case "", ChecksumNone:
+		return ChecksumNone, nil
+	case ChecksumXor8, ChecksumCrc8, ChecksumCrc16:
+		return Checksum(name), nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnknownChecksum, name)
+	}
+}
+
+func (c Checksum) Size() int {
+	switch c {
+	case ChecksumXor8, ChecksumCrc8:
+		return 1
+	case ChecksumCrc16:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// Sum computes the trailer for data.
+func (c Checksum) Sum(data []byte) []byte {
+	switch c {
+	case ChecksumXor8:
+		var sum uint8
+		for _, b := range data {
+			sum ^= b
+		}
+		return []byte{sum}
+	case ChecksumCrc8:
+		return []byte{crc8(data)}
+	case ChecksumCrc16:
+		sum := crc16(data)
+		return []byte{uint8(sum >> 8), uint8(sum)}
+	default:
+		return nil
+	}
+}
+
+func crc8(data []byte) uint8 {
+	var crc uint8
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+func crc16(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
@@ -0,0 +1,57 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestParseChecksum(t *testing.T) {
+	tests := []struct {
+		name string
+		want Checksum
+		err  error
+	}{
+		{"", ChecksumNone, nil},
+		{"none", ChecksumNone, nil},
+		{"xor8", ChecksumXor8, nil},
+		{"crc8", ChecksumCrc8, nil},
+		{"crc16", ChecksumCrc16, nil},
+		{"crc32", "", ErrUnknownChecksum},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checksum, err := ParseChecksum(test.name)
+			if checksum != test.want || !errors.Is(err, test.err) {
+				t.Errorf("ParseChecksum() = %q, %v, want %q, %v", checksum, err, test.want, test.err)
+			}
+		})
+	}
+}
+
+// TestChecksumSum checks the trailers against the standard check value of
+// each algorithm, computed over "123456789".
+func TestChecksumSum(t *testing.T) {
+	tests := []struct {
+		checksum Checksum
+		want     []byte
+	}{
+		{ChecksumNone, nil},
+		{ChecksumXor8, []byte{0x31}},
+		{ChecksumCrc8, []byte{0xf4}},
+		{ChecksumCrc16, []byte{0x29, 0xb1}},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.checksum), func(t *testing.T) {
+			sum := test.checksum.Sum([]byte("123456789"))
+			if !bytes.Equal(sum, test.want) {
+				t.Errorf("Sum() = % x, want % x", sum, test.want)
+			}
+			if size := test.checksum.Size(); size != len(test.want) {
+				t.Errorf("Size() = %d, want %d", size, len(test.want))
+			}
+		})
+	}
+}
@@ -1,22 +1,52 @@
 package packet
 
 import (
-	"encoding/binary"
+	"bytes"
+	"encoding/hex"
+	"errors"
 	"io"
-	"proton-gateway/utils"
+	"math"
 	"time"
 )
 
+// RssiUnknown is reported by packets from gateways not appending the
+// signal strength, ranking them below any measured packet.
+const RssiUnknown int8 = math.MinInt8
+
 type Packet interface {
 	Mac() string
 	Timestamp() time.Time
 	Payload() []byte
+	Gateway() string
+	Rssi() int8
+}
+
+type Options struct {
+	Gateway   string
+	Rssi      bool
+	Checksum  Checksum
+	MaxLength int
 }
 
+var ErrFrameTooLong = errors.New("packet: frame exceeds maximum length")
+var ErrChecksum = errors.New("packet: checksum mismatch")
+
 type packetImpl struct {
 	mac       string
 	timestamp time.Time
 	payload   []byte
+	gateway   string
+	rssi      int8
+}
+
+func New(mac string, timestamp time.Time, payload []byte, gateway string, rssi int8) Packet {
+	return packetImpl{
+		mac:       mac,
+		timestamp: timestamp,
+		payload:   payload,
+		gateway:   gateway,
+		rssi:      rssi,
+	}
 }
 
 func (packet packetImpl) Mac() string {
@@ -31,22 +61,59 @@ func (packet packetImpl) Payload() []byte {
 	return packet.payload
 }
 
-func Read(reader io.Reader) (Packet, error) {
-	mac, err := utils.ReadMac(reader)
-	if err != nil {
+func (packet packetImpl) Gateway() string {
+	return packet.gateway
+}
+
+func (packet packetImpl) Rssi() int8 {
+	return packet.rssi
+}
+
+// Read reads one frame: mac, payload length, payload, the optional RSSI
+// byte and the optional checksum trailer. Frames longer than
+// options.MaxLength or failing the checksum are rejected with an error
+// for which IsCorrupt reports true.
+func Read(reader io.Reader, options Options) (Packet, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(reader, header); err != nil {
 		return nil, err
 	}
-	var dataLen uint8
-	err = binary.Read(reader, binary.LittleEndian, &dataLen)
-	if err != nil {
+
+	dataLen := int(header[6])
+	if options.MaxLength > 0 && dataLen > options.MaxLength {
+		return nil, ErrFrameTooLong
+	}
+
+	trailerLen := options.Checksum.Size()
+	if options.Rssi {
+		trailerLen++
+	}
+
+	frame := make([]byte, len(header)+dataLen+trailerLen)
+	copy(frame, header)
+	if _, err := io.ReadFull(reader, frame[len(header):]); err != nil {
 		return nil, err
 	}
 
-	payload := make([]byte, dataLen)
-	_, err = reader.Read(payload)
+	body := frame[:len(frame)-options.Checksum.Size()]
+	if !bytes.Equal(options.Checksum.Sum(body), frame[len(body):]) {
+		return nil, ErrChecksum
+	}
+
+	rssi := RssiUnknown
+	if options.Rssi {
+		rssi = int8(body[len(body)-1])
+	}
+
 	return packetImpl{
-		mac:       *mac,
+		mac:       hex.EncodeToString(header[:6]),
 		timestamp: time.Now(),
-		payload:   payload,
-	}, err
+		payload:   frame[len(header) : len(header)+dataLen],
+		gateway:   options.Gateway,
+		rssi:      rssi,
+	}, nil
+}
+
+func IsCorrupt(err error) bool {
+	return err == ErrFrameTooLong || err == ErrChecksum
 }
@@ -0,0 +1,125 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// frame builds a frame for mac and payload followed by the given trailer.
+func frame(payload []byte, trailer ...byte) []byte {
+	data := []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, uint8(len(payload))}
+	data = append(data, payload...)
+	return append(data, trailer...)
+}
+
+// withSum appends the trailer of checksum to data.
+func withSum(checksum Checksum, data []byte) []byte {
+	return append(data, checksum.Sum(data)...)
+}
+
+func TestRead(t *testing.T) {
+	payload := []byte{0xde, 0xad, 0xbe, 0xef}
+
+	tests := []struct {
+		name     string
+		options  Options
+		data     []byte
+		wantRssi int8
+		wantErr  error
+	}{
+		{"plain", Options{}, frame(payload), RssiUnknown, nil},
+		{"rssi", Options{Rssi: true}, frame(payload, 0xba), -70, nil},
+		{"empty payload", Options{}, frame(nil), RssiUnknown, nil},
+		{"within max length", Options{MaxLength: 4}, frame(payload), RssiUnknown, nil},
+		{"beyond max length", Options{MaxLength: 3}, frame(payload), 0, ErrFrameTooLong},
+		{"xor8", Options{Checksum: ChecksumXor8}, withSum(ChecksumXor8, frame(payload)), RssiUnknown, nil},
+		{"crc8", Options{Checksum: ChecksumCrc8}, withSum(ChecksumCrc8, frame(payload)), RssiUnknown, nil},
+		{"crc16", Options{Checksum: ChecksumCrc16}, withSum(ChecksumCrc16, frame(payload)), RssiUnknown, nil},
+		{"crc16 with rssi", Options{Checksum: ChecksumCrc16, Rssi: true}, withSum(ChecksumCrc16, frame(payload, 0xba)), -70, nil},
+		{"xor8 corrupt", Options{Checksum: ChecksumXor8}, append(frame(payload), 0x00), 0, ErrChecksum},
+		{"crc8 corrupt", Options{Checksum: ChecksumCrc8}, corrupt(withSum(ChecksumCrc8, frame(payload)), 8), 0, ErrChecksum},
+		{"crc16 corrupt", Options{Checksum: ChecksumCrc16}, corrupt(withSum(ChecksumCrc16, frame(payload)), 8), 0, ErrChecksum},
+		{"crc16 corrupt trailer", Options{Checksum: ChecksumCrc16}, corrupt(withSum(ChecksumCrc16, frame(payload)), 12), 0, ErrChecksum},
+		{"crc16 corrupt rssi", Options{Checksum: ChecksumCrc16, Rssi: true}, corrupt(withSum(ChecksumCrc16, frame(payload, 0xba)), 11), 0, ErrChecksum},
+		{"short header", Options{}, frame(payload)[:5], 0, io.ErrUnexpectedEOF},
+		{"short payload", Options{}, frame(payload)[:9], 0, io.ErrUnexpectedEOF},
+		{"missing rssi", Options{Rssi: true}, frame(payload), 0, io.ErrUnexpectedEOF},
+		{"missing checksum", Options{Checksum: ChecksumCrc16}, frame(payload), 0, io.ErrUnexpectedEOF},
+		{"nothing", Options{}, nil, 0, io.EOF},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.options.Gateway = "attic"
+
+			p, err := Read(bytes.NewReader(test.data), test.options)
+			if !errors.Is(err, test.wantErr) || (test.wantErr == nil && err != nil) {
+				t.Fatalf("Read() = %v, want %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if p.Mac() != "0123456789ab" {
+				t.Errorf("Mac() = %q, want 0123456789ab", p.Mac())
+			}
+			if !bytes.Equal(p.Payload(), test.data[7:7+int(test.data[6])]) {
+				t.Errorf("Payload() = % x, want % x", p.Payload(), test.data[7:7+int(test.data[6])])
+			}
+			if p.Rssi() != test.wantRssi {
+				t.Errorf("Rssi() = %d, want %d", p.Rssi(), test.wantRssi)
+			}
+			if p.Gateway() != "attic" {
+				t.Errorf("Gateway() = %q, want attic", p.Gateway())
+			}
+		})
+	}
+}
+
+// TestReadConsumesRejectedFrames checks that a frame failing its checksum is
+// read completely, so the next frame still starts at its header.
+func TestReadConsumesRejectedFrames(t *testing.T) {
+	options := Options{Checksum: ChecksumCrc8}
+	stream := bytes.NewReader(append(
+		corrupt(withSum(ChecksumCrc8, frame([]byte{0x01})), 7),
+		withSum(ChecksumCrc8, frame([]byte{0x02}))...,
+	))
+
+	if _, err := Read(stream, options); err != ErrChecksum {
+		t.Fatalf("Read() = %v, want %v", err, ErrChecksum)
+	}
+	p, err := Read(stream, options)
+	if err != nil {
+		t.Fatalf("Read() after corrupt frame = %v", err)
+	}
+	if !bytes.Equal(p.Payload(), []byte{0x02}) {
+		t.Errorf("Payload() = % x, want 02", p.Payload())
+	}
+}
+
+func TestIsCorrupt(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{ErrFrameTooLong, true},
+		{ErrChecksum, true},
+		{io.ErrUnexpectedEOF, false},
+		{io.EOF, false},
+		{nil, false},
+	}
+
+	for _, test := range tests {
+		if got := IsCorrupt(test.err); got != test.want {
+			t.Errorf("IsCorrupt(%v) = %t, want %t", test.err, got, test.want)
+		}
+	}
+}
+
+// corrupt flips a bit of the byte at index.
+func corrupt(data []byte, index int) []byte {
+	data[index] ^= 0x10
+	return data
+}
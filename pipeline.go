@@ -0,0 +1,178 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"proton-gateway/aggregate"
+	"proton-gateway/config"
+	"proton-gateway/device"
+	"proton-gateway/discovery"
+	"proton-gateway/gateway"
+	"proton-gateway/homeassistant"
+	"proton-gateway/message"
+	"proton-gateway/packet"
+	"proton-gateway/policy"
+	"proton-gateway/store"
+	"proton-gateway/topic"
+	"sort"
+	"time"
+)
+
+// pipeline turns packets into messages. Packets are handed to the device of
+// their MAC, whose states then pass the device's publishing policy and feed
+// its aggregation.
+type pipeline struct {
+	layout      *topic.Layout
+	devices     map[string]device.Device
+	policies    map[string]*policy.Policy
+	aggregators map[string]*aggregate.Aggregator
+	// topics of the bridge and its gateways, which no device may take
+	reserved []topic.Topics
+}
+
+// buildPipeline builds the configured devices. It fails if their topics
+// collide with each other or with those of the bridge and its gateways.
+func buildPipeline(conf *config.Config, layout *topic.Layout, state store.Store) (*pipeline, error) {
+	pl := &pipeline{
+		layout:      layout,
+		devices:     make(map[string]device.Device),
+		policies:    make(map[string]*policy.Policy),
+		aggregators: make(map[string]*aggregate.Aggregator),
+	}
+
+	pl.reserved = append(pl.reserved, topic.Topics{
+		Owner:  "bridge",
+		Topics: []string{homeassistant.BridgeStatusTopic(layout), discovery.PendingTopic(layout), discovery.AdoptTopic(layout)},
+	})
+	for _, gatewayConfig := range conf.Gateways {
+		pl.reserved = append(pl.reserved, gateway.Topics(layout, gatewayConfig.Name))
+	}
+
+	for _, deviceConfig := range conf.Devices {
+		dev, err := buildDevice(deviceConfig, layout, state)
+		if err == device.ErrUnknownType {
+			log.Warnf("unknown device type %s. Packets for %s won't be handled", deviceConfig.Type, deviceConfig.Mac)
+			continue
+		}
+		if err != nil {
+			log.Errorf("error starting device %s: %v", deviceConfig.Mac, err)
+			continue
+		}
+
+		pl.add(deviceConfig, dev)
+	}
+
+	if err := pl.checkTopics(); err != nil {
+		stopDevices(pl.devices)
+		return nil, err
+	}
+
+	return pl, nil
+}
+
+func (pl *pipeline) add(deviceConfig config.DeviceConfig, dev device.Device) {
+	pl.devices[deviceConfig.Mac] = dev
+
+	if deviceConfig.Publish != nil {
+		pl.policies[deviceConfig.Mac] = policy.New(*deviceConfig.Publish)
+	}
+	if deviceConfig.Aggregation != nil {
+		pl.aggregators[deviceConfig.Mac] = aggregate.New(*deviceConfig.Aggregation, pl.layout, topic.NewDevice(deviceConfig, dev.Id()), dev.StateTopic())
+	}
+}
+
+// remove takes back the device of mac added last, which turned out unusable.
+func (pl *pipeline) remove(mac string) {
+	delete(pl.devices, mac)
+	delete(pl.policies, mac)
+	delete(pl.aggregators, mac)
+}
+
+// checkTopics checks the topics of the devices against each other and
+// against the ones of the bridge and its gateways, as names may make them
+// collide or unusable.
+func (pl *pipeline) checkTopics() error {
+	macs := make([]string, 0, len(pl.devices))
+	for mac := range pl.devices {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+
+	owners := append([]topic.Topics(nil), pl.reserved...)
+	for _, mac := range macs {
+		owners = append(owners, pl.topics(mac))
+	}
+
+	return pl.layout.Check(owners...)
+}
+
+// topics returns the topics of the device of mac: its state, availability
+// and command topics, those of its statistics, and the discovery topics of
+// every entity it announces, aggregates included.
+func (pl *pipeline) topics(mac string) topic.Topics {
+	dev := pl.devices[mac]
+
+	topics := topic.Topics{Owner: "device " + mac, Topics: []string{dev.StateTopic()}}
+	for _, msg := range dev.Offline() {
+		topics.Topics = append(topics.Topics, msg.Topic())
+	}
+	if commander, ok := dev.(device.Commander); ok {
+		topics.Topics = append(topics.Topics, commander.CommandTopic())
+	}
+	if aggregator, found := pl.aggregators[mac]; found {
+		topics.Topics = append(topics.Topics, aggregator.Topics()...)
+	}
+	for _, msg := range pl.configuration(mac, "") {
+		topics.Discovery = append(topics.Discovery, msg.Topic())
+	}
+
+	return topics
+}
+
+// configuration returns the discovery messages of the device and of its
+// aggregates.
+func (pl *pipeline) configuration(mac string, viaDevice string) []message.Message {
+	configuration := pl.devices[mac].Configuration(viaDevice)
+	if aggregator, found := pl.aggregators[mac]; found {
+		configuration = append(configuration, aggregator.Configuration(configuration)...)
+	}
+
+	return configuration
+}
+
+func (pl *pipeline) process(p packet.Packet) []message.Message {
+	dev, found := pl.devices[p.Mac()]
+	if !found {
+		log.Warnf("received packet from unknown device: %s", p.Mac())
+		return nil
+	}
+
+	publishPolicy := pl.policies[p.Mac()]
+	aggregator := pl.aggregators[p.Mac()]
+
+	var messages []message.Message
+	for _, msg := range dev.Process(p) {
+		if msg.Topic() != dev.StateTopic() {
+			messages = append(messages, msg)
+			continue
+		}
+
+		if aggregator != nil {
+			aggregator.Add(p.Timestamp(), msg.Payload())
+		}
+		if publishPolicy == nil || publishPolicy.Allow(p.Timestamp(), msg.Payload()) {
+			messages = append(messages, msg)
+		}
+	}
+
+	return messages
+}
+
+// publishStats returns the statistics of every aggregator due at now.
+func (pl *pipeline) publishStats(now time.Time) []message.Message {
+	var messages []message.Message
+	for _, aggregator := range pl.aggregators {
+		messages = append(messages, aggregator.Publish(now)...)
+	}
+
+	return messages
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"proton-gateway/config"
+	"proton-gateway/topic"
+	"strings"
+	"testing"
+)
+
+func TestBuildPipelineChecksTopics(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr error
+	}{
+		{"defaults", `
+gateways:
+  - name: attic
+    port: /dev/null
+devices:
+  - type: ht
+    mac: 0123456789ab
+    aggregation:
+      windows: [5m]
+      homeassistant: true
+`, nil},
+		{"device taking a gateway topic", `
+gateways:
+  - name: attic
+    port: /dev/null
+topics:
+  state: "{{ .base }}/{{ .name }}/state"
+devices:
+  - type: ht
+    mac: 0123456789ab
+    name: gateway-attic
+`, topic.ErrInvalidTopic},
+		{"device taking a bridge topic", `
+topics:
+  state: "{{ .base }}/{{ .name }}/pending"
+devices:
+  - type: ht
+    mac: 0123456789ab
+    name: discovery
+`, topic.ErrInvalidTopic},
+		{"name unusable in discovery topics", `
+topics:
+  discovery: "{{ .prefix }}/{{ .component }}/{{ .name }}/{{ .field }}/config"
+devices:
+  - type: ht
+    mac: 0123456789ab
+    name: Living Room
+`, topic.ErrInvalidTopic},
+		{"fields apart without aggregates", `
+topics:
+  discovery: "{{ .prefix }}/{{ .component }}/{{ .id }}/{{ printf \"%.11s\" .field }}/config"
+devices:
+  - type: ht
+    mac: 0123456789ab
+`, nil},
+		{"aggregate colliding with its field", `
+topics:
+  discovery: "{{ .prefix }}/{{ .component }}/{{ .id }}/{{ printf \"%.11s\" .field }}/config"
+devices:
+  - type: ht
+    mac: 0123456789ab
+    aggregation:
+      windows: [5m]
+      homeassistant: true
+`, topic.ErrInvalidTopic},
+		{"statistics taking a state topic", `
+topics:
+  state: "{{ .base }}/{{ .name }}"
+devices:
+  - type: ht
+    mac: 0123456789ab
+    name: kitchen
+    aggregation:
+      windows: [5m]
+  - type: ht
+    mac: ba9876543210
+    name: kitchen/stats/5m
+`, topic.ErrInvalidTopic},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conf, err := config.Load(strings.NewReader(test.yaml))
+			if err != nil {
+				t.Fatalf("config.Load() = %v", err)
+			}
+			layout, err := topic.NewLayout(conf.Topics)
+			if err != nil {
+				t.Fatalf("topic.NewLayout() = %v", err)
+			}
+
+			_, err = buildPipeline(conf, layout, openStore(""))
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("buildPipeline() = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestAdoptedDeviceTopicsChecked(t *testing.T) {
+	conf, err := config.Load(strings.NewReader(`
+topics:
+  state: "{{ .base }}/{{ .name }}/state"
+devices:
+  - type: ht
+    mac: 0123456789ab
+    name: kitchen
+`))
+	if err != nil {
+		t.Fatalf("config.Load() = %v", err)
+	}
+	layout, err := topic.NewLayout(conf.Topics)
+	if err != nil {
+		t.Fatalf("topic.NewLayout() = %v", err)
+	}
+	pl, err := buildPipeline(conf, layout, openStore(""))
+	if err != nil {
+		t.Fatalf("buildPipeline() = %v", err)
+	}
+
+	// a name taken by a configured device makes the state topics collide
+	adopted := config.DeviceConfig{Type: "ht", Mac: "ba9876543210", Name: "kitchen"}
+	dev, err := buildDevice(adopted, layout, openStore(""))
+	if err != nil {
+		t.Fatalf("buildDevice() = %v", err)
+	}
+	pl.add(adopted, dev)
+	if err := pl.checkTopics(); !errors.Is(err, topic.ErrInvalidTopic) {
+		t.Errorf("checkTopics() = %v, want %v", err, topic.ErrInvalidTopic)
+	}
+
+	pl.remove(adopted.Mac)
+	if err := pl.checkTopics(); err != nil {
+		t.Errorf("checkTopics() after remove = %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package policy
+
+import (
+	"encoding/json"
+	"math"
+	"proton-gateway/config"
+	"time"
+)
+
+// Policy decides which states of one device are published. Timestamps are
+// those of the packets, so replayed captures are treated like live traffic.
+type Policy struct {
+	deadband    map[string]float64
+	heartbeat   time.Duration
+	minInterval time.Duration
+
+	published   map[string]interface{}
+	publishedAt time.Time
+}
+
+func New(conf config.PublishConfig) *Policy {
+	return &Policy{
+		deadband:    conf.Deadband,
+		heartbeat:   conf.Heartbeat,
+		minInterval: conf.MinInterval,
+	}
+}
+
+// Allow reports whether the state payload received at now is published and
+// remembers it as the last published state if so.
+func (p *Policy) Allow(now time.Time, payload []byte) bool {
+	values := make(map[string]interface{})
+	if err := json.Unmarshal(payload, &values); err != nil {
+		return true
+	}
+
+	if !p.publishedAt.IsZero() {
+		since := now.Sub(p.publishedAt)
+		if since < p.minInterval {
+			return false
+		}
+
+		heartbeatDue := p.heartbeat > 0 && since >= p.heartbeat
+		if !heartbeatDue && !p.changed(values) {
+			return false
+		}
+	}
+
+	p.published = values
+	p.publishedAt = now
+	return true
+}
+
+// changed reports whether a field with a deadband moved out of it. Without
+// deadbands every state counts as changed.
+func (p *Policy) changed(values map[string]interface{}) bool {
+	if len(p.deadband) == 0 {
+		return true
+	}
+
+	for field, band := range p.deadband {
+		current, currentOk := values[field].(float64)
+		previous, previousOk := p.published[field].(float64)
+		if currentOk != previousOk {
+			return true
+		}
+		if currentOk && math.Abs(current-previous) > band {
+			return true
+		}
+	}
+
+	return false
+}
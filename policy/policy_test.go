@@ -0,0 +1,131 @@
+package policy
+
+import (
+	"proton-gateway/config"
+	"testing"
+	"time"
+)
+
+func TestPolicyAllow(t *testing.T) {
+	type step struct {
+		at      time.Duration
+		payload string
+		want    bool
+	}
+
+	tests := []struct {
+		name  string
+		conf  config.PublishConfig
+		steps []step
+	}{
+		{
+			"unlimited",
+			config.PublishConfig{},
+			[]step{
+				{0, `{"temperature":20}`, true},
+				{time.Second, `{"temperature":20}`, true},
+				{time.Second, `{"temperature":20}`, true},
+			},
+		},
+		{
+			"min interval",
+			config.PublishConfig{MinInterval: 10 * time.Second},
+			[]step{
+				{0, `{"temperature":20}`, true},
+				{5 * time.Second, `{"temperature":25}`, false},
+				{10 * time.Second, `{"temperature":25}`, true},
+				{19 * time.Second, `{"temperature":30}`, false},
+				{20 * time.Second, `{"temperature":30}`, true},
+			},
+		},
+		{
+			"deadband",
+			config.PublishConfig{Deadband: map[string]float64{"temperature": 0.5}},
+			[]step{
+				{0, `{"temperature":20}`, true},
+				{time.Second, `{"temperature":20.4}`, false},
+				{2 * time.Second, `{"temperature":20.5}`, false},
+				{3 * time.Second, `{"temperature":20.6}`, true},
+				{4 * time.Second, `{"temperature":20.2}`, false},
+				{5 * time.Second, `{"temperature":20}`, true},
+			},
+		},
+		{
+			"deadband ignores other fields",
+			config.PublishConfig{Deadband: map[string]float64{"temperature": 0.5}},
+			[]step{
+				{0, `{"temperature":20,"humidity":40}`, true},
+				{time.Second, `{"temperature":20,"humidity":60}`, false},
+			},
+		},
+		{
+			"deadband field appearing or vanishing",
+			config.PublishConfig{Deadband: map[string]float64{"temperature": 0.5}},
+			[]step{
+				{0, `{"humidity":40}`, true},
+				{time.Second, `{"humidity":40}`, false},
+				{2 * time.Second, `{"temperature":20,"humidity":40}`, true},
+				{3 * time.Second, `{"humidity":40}`, true},
+			},
+		},
+		{
+			"heartbeat",
+			config.PublishConfig{Deadband: map[string]float64{"temperature": 0.5}, Heartbeat: time.Minute},
+			[]step{
+				{0, `{"temperature":20}`, true},
+				{59 * time.Second, `{"temperature":20}`, false},
+				{time.Minute, `{"temperature":20}`, true},
+				{90 * time.Second, `{"temperature":20}`, false},
+				{2 * time.Minute, `{"temperature":20}`, true},
+			},
+		},
+		{
+			"heartbeat restarts on change",
+			config.PublishConfig{Deadband: map[string]float64{"temperature": 0.5}, Heartbeat: time.Minute},
+			[]step{
+				{0, `{"temperature":20}`, true},
+				{30 * time.Second, `{"temperature":21}`, true},
+				{time.Minute, `{"temperature":21}`, false},
+				{90 * time.Second, `{"temperature":21}`, true},
+			},
+		},
+		{
+			"min interval holds back the heartbeat",
+			config.PublishConfig{Deadband: map[string]float64{"temperature": 0.5}, Heartbeat: time.Second, MinInterval: 10 * time.Second},
+			[]step{
+				{0, `{"temperature":20}`, true},
+				{5 * time.Second, `{"temperature":20}`, false},
+				{10 * time.Second, `{"temperature":20}`, true},
+			},
+		},
+		{
+			"out of order within min interval",
+			config.PublishConfig{MinInterval: 10 * time.Second},
+			[]step{
+				{time.Minute, `{"temperature":20}`, true},
+				{30 * time.Second, `{"temperature":25}`, false},
+				{70 * time.Second, `{"temperature":25}`, true},
+			},
+		},
+		{
+			"not json",
+			config.PublishConfig{MinInterval: 10 * time.Second},
+			[]step{
+				{0, `{"temperature":20}`, true},
+				{time.Second, `offline`, true},
+			},
+		},
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy := New(test.conf)
+			for i, step := range test.steps {
+				if got := policy.Allow(start.Add(step.at), []byte(step.payload)); got != step.want {
+					t.Errorf("step %d: Allow(%s, %s) = %t, want %t", i, step.at, step.payload, got, step.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"flag"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"os/signal"
+	"proton-gateway/capture"
+	"proton-gateway/config"
+	"proton-gateway/dedup"
+	"proton-gateway/message"
+	"proton-gateway/packet"
+	"syscall"
+	"time"
+)
+
+func replay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	configFile := flags.String("config", "config.yaml", "configuration file")
+	speed := flags.Float64("speed", 1, "replay speed factor, 0 replays as fast as possible")
+	noMqtt := flags.Bool("no-mqtt", false, "log resulting messages instead of publishing them")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		log.Fatalf("usage: proton-gateway replay [flags] <capture file>")
+	}
+
+	conf, layout := loadConfig(*configFile)
+
+	reader, err := capture.Open(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("error opening capture file: %v", err)
+	}
+	defer reader.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	loadDefinitions(conf.Definitions)
+	// replaying must not overwrite the state of the live bridge
+	pl, err := buildPipeline(conf, layout, openStore(""))
+	if err != nil {
+		log.Fatalf("error loading configuration: %v", err)
+	}
+	defer stopDevices(pl.devices)
+
+	emit := func(msg message.Message) {
+		log.Infof("%s: %s", msg.Topic(), msg.Payload())
+	}
+	if !*noMqtt {
+		client := connectMqttTool(conf.Mqtt, "replay")
+		defer client.Disconnect(uint(disconnectQuiesce.Milliseconds()))
+
+		// discovery is left to the live bridge, which announces the entities
+		// with their gateway as via_device
+		emit = func(msg message.Message) {
+			publish(client, msg)
+		}
+	}
+
+	count, err := replayCapture(ctx, reader, conf.Deduplication, pl, *speed, emit)
+	if err != nil {
+		log.Fatalf("error replaying capture: %v", err)
+	}
+
+	log.Infof("replayed %d packets", count)
+}
+
+// replayCapture feeds the packets of a capture through deduplication and the
+// pipeline, keeping the recorded timing scaled by speed, and returns how many
+// were read. Deduplication follows the clock of the capture and every message
+// is emitted on the calling goroutine, so a replay is processed like the live
+// bridge processes packets, in the same order every time. Statistics are
+// published by the time of the packets instead of a ticker.
+func replayCapture(ctx context.Context, reader *capture.Reader, conf config.DeduplicationConfig, pl *pipeline, speed float64, emit func(message.Message)) (int, error) {
+	deduplicator, err := dedup.NewClocked(conf.Strategy, conf.Window, func(p packet.Packet) {
+		for _, msg := range pl.process(p) {
+			emit(msg)
+		}
+		for _, msg := range pl.publishStats(p.Timestamp()) {
+			emit(msg)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	var previous time.Time
+	for ctx.Err() == nil {
+		p, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			log.Warnf("capture ends with a truncated record")
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+
+		if speed > 0 && !previous.IsZero() {
+			delay := time.Duration(float64(p.Timestamp().Sub(previous)) / speed)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+		}
+		previous = p.Timestamp()
+
+		deduplicator.Add(p)
+		count++
+	}
+
+	deduplicator.Close()
+	return count, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"proton-gateway/capture"
+	"proton-gateway/config"
+	"proton-gateway/message"
+	"proton-gateway/packet"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func htPayload(temperature float32) []byte {
+	buffer := bytes.Buffer{}
+	for _, value := range []float32{temperature, 45, 3.9, 12} {
+		_ = binary.Write(&buffer, binary.LittleEndian, value)
+	}
+
+	return buffer.Bytes()
+}
+
+// writeCapture writes packets heard at offsets from a fixed start.
+func writeCapture(t *testing.T, packets []packet.Packet) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "packets.cap")
+	writer, err := capture.Create(path)
+	if err != nil {
+		t.Fatalf("capture.Create() = %v", err)
+	}
+	for _, p := range packets {
+		if err := writer.Write(p); err != nil {
+			t.Fatalf("Write() = %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	return path
+}
+
+func TestReplayCaptureIsOrderedAndDeterministic(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	heard := func(mac string, temperature float32, gateway string, rssi int8, after time.Duration) packet.Packet {
+		return packet.New(mac, start.Add(after), htPayload(temperature), gateway, rssi)
+	}
+	path := writeCapture(t, []packet.Packet{
+		heard("0123456789ab", 20, "attic", -80, 0),
+		heard("0123456789ab", 20, "cellar", -40, 100*time.Millisecond),
+		heard("ba9876543210", 30, "attic", -70, 200*time.Millisecond),
+		heard("ba9876543210", 30, "cellar", -75, 300*time.Millisecond),
+		heard("0123456789ab", 21, "attic", -80, 3*time.Second),
+		heard("ba9876543210", 31, "cellar", -60, 3*time.Second),
+	})
+
+	conf, err := config.Load(strings.NewReader(`
+deduplication:
+  strategy: strongest
+  window: 2s
+devices:
+  - type: ht
+    mac: 0123456789ab
+  - type: ht
+    mac: ba9876543210
+`))
+	if err != nil {
+		t.Fatalf("config.Load() = %v", err)
+	}
+
+	want := []string{"0123456789ab 20", "ba9876543210 30", "0123456789ab 21", "ba9876543210 31"}
+	for run := 0; run < 20; run++ {
+		reader, err := capture.Open(path)
+		if err != nil {
+			t.Fatalf("capture.Open() = %v", err)
+		}
+
+		pl, err := buildPipeline(conf, defaultLayout(t), openStore(""))
+		if err != nil {
+			t.Fatalf("buildPipeline() = %v", err)
+		}
+		stateTopics := make(map[string]string)
+		for mac, dev := range pl.devices {
+			stateTopics[dev.StateTopic()] = mac
+		}
+
+		var states []string
+		count, err := replayCapture(context.Background(), reader, conf.Deduplication, pl, 0, func(msg message.Message) {
+			mac, found := stateTopics[msg.Topic()]
+			if !found {
+				return
+			}
+
+			state := struct {
+				Temperature float32 `json:"temperature"`
+			}{}
+			if err := json.Unmarshal(msg.Payload(), &state); err != nil {
+				t.Fatalf("invalid state %s: %v", msg.Payload(), err)
+			}
+			states = append(states, fmt.Sprintf("%s %g", mac, state.Temperature))
+		})
+		_ = reader.Close()
+		stopDevices(pl.devices)
+
+		if err != nil {
+			t.Fatalf("replayCapture() = %v", err)
+		}
+		if count != 6 {
+			t.Errorf("replayed %d packets, want 6", count)
+		}
+		if !reflect.DeepEqual(states, want) {
+			t.Fatalf("run %d published states %v, want %v", run, states, want)
+		}
+	}
+}
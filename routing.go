@@ -0,0 +1,59 @@
+package main
+
+import (
+	"proton-gateway/gateway"
+	"proton-gateway/packet"
+	"sync"
+)
+
+// gateways keeps track of which gateway to send downlink packets through.
+// Devices without a configured gateway use the one that heard them last.
+type gateways struct {
+	all    []gateway.Gateway
+	byName map[string]gateway.Gateway
+
+	lock      sync.Mutex
+	preferred map[string]string
+	lastHeard map[string]string
+}
+
+func newGateways() *gateways {
+	return &gateways{
+		byName:    make(map[string]gateway.Gateway),
+		preferred: make(map[string]string),
+		lastHeard: make(map[string]string),
+	}
+}
+
+func (g *gateways) add(gw gateway.Gateway) {
+	g.all = append(g.all, gw)
+	g.byName[gw.Name()] = gw
+}
+
+func (g *gateways) prefer(mac string, name string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.preferred[mac] = name
+}
+
+func (g *gateways) heard(p packet.Packet) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.lastHeard[p.Mac()] = p.Gateway()
+}
+
+func (g *gateways) route(mac string) gateway.Gateway {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if gw, found := g.byName[g.preferred[mac]]; found {
+		return gw
+	}
+	if gw, found := g.byName[g.lastHeard[mac]]; found {
+		return gw
+	}
+
+	return g.all[0]
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"proton-gateway/config"
+	"proton-gateway/device"
+	"proton-gateway/gateway"
+	"proton-gateway/homeassistant"
+	"proton-gateway/message"
+	"proton-gateway/store"
+	"proton-gateway/topic"
+	"strings"
+	"time"
+)
+
+// loadConfig loads the configuration and the topic layout it describes.
+func loadConfig(path string) (*config.Config, *topic.Layout) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("error opening %s: %v", path, err)
+	}
+	log.Infof("configuration opened")
+
+	conf, err := config.Load(file)
+	if err != nil {
+		log.Fatalf("error loading configuration: %v", err)
+	}
+	_ = file.Close()
+	layout, err := topic.NewLayout(conf.Topics)
+	if err != nil {
+		log.Fatalf("error loading configuration: %v", err)
+	}
+	log.Infof("configuration loaded")
+
+	return conf, layout
+}
+
+// connectMqtt connects the bridge. Its status is published online on every
+// connect, followed by onConnect, and the broker publishes it offline once the
+// connection is lost.
+func connectMqtt(conf config.MqttConfig, layout *topic.Layout, onConnect mqtt.OnConnectHandler) mqtt.Client {
+	options := mqttOptions(conf, conf.ClientId)
+	options.SetWill(homeassistant.BridgeStatusTopic(layout), "offline", 1, true)
+	options.SetOnConnectHandler(func(client mqtt.Client) {
+		client.Publish(homeassistant.BridgeStatusTopic(layout), 1, true, "online")
+		onConnect(client)
+	})
+
+	return dialMqtt(options)
+}
+
+// connectMqttTool connects a subcommand, which must not touch the bridge
+// status and must not take over the connection of a running bridge.
+func connectMqttTool(conf config.MqttConfig, command string) mqtt.Client {
+	clientId := conf.ClientId
+	if clientId != "" {
+		clientId = fmt.Sprintf("%s-%s", clientId, command)
+	}
+
+	return dialMqtt(mqttOptions(conf, clientId))
+}
+
+// disconnectMqtt marks the bridge offline, which the broker only does by itself
+// when the connection is lost, and disconnects.
+func disconnectMqtt(client mqtt.Client, layout *topic.Layout) {
+	client.Publish(homeassistant.BridgeStatusTopic(layout), 1, true, "offline").Wait()
+	client.Disconnect(uint(disconnectQuiesce.Milliseconds()))
+}
+
+func mqttOptions(conf config.MqttConfig, clientId string) *mqtt.ClientOptions {
+	log.Infof("creating new mqtt client")
+	options := mqtt.NewClientOptions()
+	options.SetAutoReconnect(true)
+	options.AddBroker(conf.Broker())
+	options.SetClientID(clientId)
+	options.SetKeepAlive(conf.Keepalive)
+
+	password, err := mqttPassword(conf)
+	if err != nil {
+		log.Fatalf("error reading mqtt password: %v", err)
+	}
+	options.SetUsername(conf.Username)
+	options.SetPassword(password)
+
+	if conf.Secure() {
+		tlsConfig, err := mqttTlsConfig(conf.Tls)
+		if err != nil {
+			log.Fatalf("error configuring mqtt tls: %v", err)
+		}
+		if conf.Tls.InsecureSkipVerify {
+			log.Warnf("mqtt broker certificate is not verified")
+		}
+		options.SetTLSConfig(tlsConfig)
+	}
+
+	return options
+}
+
+func dialMqtt(options *mqtt.ClientOptions) mqtt.Client {
+	client := mqtt.NewClient(options)
+
+	log.Infof("connecting to mqtt server")
+	token := client.Connect()
+	token.Wait()
+	if token.Error() != nil {
+		log.Fatalf("error connecting to mqtt broker: %v", token.Error())
+	}
+	log.Infof("connected to mqtt server")
+
+	return client
+}
+
+// mqttPassword returns the configured password, preferring the file over the
+// environment variable over the plain value.
+func mqttPassword(conf config.MqttConfig) (string, error) {
+	switch {
+	case conf.PasswordFile != "":
+		password, err := os.ReadFile(conf.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(password), "\r\n"), nil
+	case conf.PasswordEnv != "":
+		password, found := os.LookupEnv(conf.PasswordEnv)
+		if !found {
+			return "", fmt.Errorf("environment variable %s not set", conf.PasswordEnv)
+		}
+		return password, nil
+	default:
+		return conf.Password, nil
+	}
+}
+
+func mqttTlsConfig(conf config.TlsConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+
+	if conf.Ca != "" {
+		ca, err := os.ReadFile(conf.Ca)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", conf.Ca)
+		}
+	}
+
+	if conf.Cert != "" || conf.Key != "" {
+		certificate, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+// loadDefinitions registers the device definitions matching the configured
+// glob patterns.
+func loadDefinitions(patterns []string) {
+	for _, pattern := range patterns {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Fatalf("invalid definitions pattern %s: %v", pattern, err)
+		}
+
+		for _, path := range paths {
+			file, err := os.Open(path)
+			if err != nil {
+				log.Fatalf("error opening %s: %v", path, err)
+			}
+
+			def, err := device.LoadDefinition(file)
+			_ = file.Close()
+			if err != nil {
+				log.Fatalf("error loading definition %s: %v", path, err)
+			}
+
+			device.RegisterDefinition(def)
+			log.Infof("registered device type %s from %s", def.Type, path)
+		}
+	}
+}
+
+func buildDevice(deviceConfig config.DeviceConfig, layout *topic.Layout, state store.Store) (device.Device, error) {
+	dev, err := device.NewDevice(deviceConfig, layout)
+	if err != nil {
+		return nil, err
+	}
+
+	if stateful, ok := dev.(device.Stateful); ok {
+		if err := stateful.Restore(state); err != nil {
+			log.Warnf("error restoring state of device %s: %v", deviceConfig.Mac, err)
+		}
+	}
+
+	if starter, ok := dev.(device.Starter); ok {
+		if err := starter.Start(); err != nil {
+			return nil, err
+		}
+	}
+
+	return dev, nil
+}
+
+func announceDevice(client mqtt.Client, manifest *discoveryManifest, mac string, configuration []message.Message) {
+	log.Infof("announcing configuration for device: %s", mac)
+	for _, msg := range configuration {
+		publish(client, msg)
+	}
+	clearDiscovery(client, manifest.add(mac, configuration))
+}
+
+// announceGateway announces the gateway once it is connected and returns a
+// function announcing it again whenever its MAC changed, like after the
+// stick was swapped. The function reports whether it announced the gateway.
+func announceGateway(client mqtt.Client, layout *topic.Layout, state store.Store, manifest *discoveryManifest, gw gateway.Gateway) func() bool {
+	var announced string
+	announce := func() bool {
+		mac := gw.Mac()
+		if mac == "" || mac == announced {
+			return false
+		}
+		announced = mac
+
+		log.Infof("announcing configuration for gateway: %s", gw.Name())
+		configuration := gateway.Configuration(layout, gw)
+		for _, msg := range configuration {
+			publish(client, msg)
+		}
+		clearDiscovery(client, manifest.add(gatewayKey(gw.Name()), configuration))
+		rememberDiscovery(state, manifest)
+		return true
+	}
+
+	announce()
+	return announce
+}
+
+// announceRouted announces the devices routed through gw again, so those
+// announced while it was not connected, or had another MAC, reference it as
+// their via_device.
+func announceRouted(client mqtt.Client, state store.Store, manifest *discoveryManifest, pl *pipeline, gws *gateways, gw gateway.Gateway) {
+	for mac := range pl.devices {
+		if gws.route(mac) == gw {
+			announceDevice(client, manifest, mac, pl.configuration(mac, gateway.DeviceId(gw)))
+		}
+	}
+	rememberDiscovery(state, manifest)
+}
+
+func subscribeCommands(ctx context.Context, client mqtt.Client, gws *gateways, mac string, dev device.Device) {
+	commander, ok := dev.(device.Commander)
+	if !ok {
+		return
+	}
+
+	client.Subscribe(commander.CommandTopic(), 0, func(client mqtt.Client, m mqtt.Message) {
+		frame, err := commander.Command(m.Payload())
+		if err != nil {
+			log.Warnf("invalid command for device %s: %v", mac, err)
+			return
+		}
+
+		gw := gws.route(mac)
+		go func() {
+			if err := gw.Send(ctx, mac, frame); err != nil {
+				log.Errorf("error sending command to device %s via %s: %v", mac, gw.Name(), err)
+			}
+		}()
+	})
+}
+
+func stopDevices(devices map[string]device.Device) {
+	for mac, dev := range devices {
+		stopper, ok := dev.(device.Stopper)
+		if !ok {
+			continue
+		}
+
+		if err := stopper.Stop(); err != nil {
+			log.Warnf("error stopping device %s: %v", mac, err)
+		}
+	}
+}
+
+func openStore(path string) store.Store {
+	state, err := store.Open(path)
+	if err != nil {
+		log.Fatalf("error opening state store %s: %v", path, err)
+	}
+
+	return state
+}
+
+func flushStore(ctx context.Context, state store.Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := state.Flush(); err != nil {
+				log.Errorf("error flushing state store: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func publish(client mqtt.Client, msg message.Message) {
+	client.Publish(msg.Topic(), msg.Qos(), msg.Retain(), msg.Payload()).Wait()
+}
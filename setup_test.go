@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"proton-gateway/config"
+	"proton-gateway/gateway"
+	"proton-gateway/homeassistant"
+	"proton-gateway/topic"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	log.SetOutput(io.Discard)
+}
+
+// defaultLayout returns the topic layout of an empty topics section.
+func defaultLayout(t *testing.T) *topic.Layout {
+	layout, err := topic.NewLayout(config.TopicsConfig{})
+	if err != nil {
+		t.Fatalf("topic.NewLayout() = %v", err)
+	}
+
+	return layout
+}
+
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (doneToken) Error() error { return nil }
+
+// fakeClient records the last payload published to every topic.
+type fakeClient struct {
+	mqtt.Client
+
+	lock      sync.Mutex
+	published map[string][]byte
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{published: make(map[string][]byte)}
+}
+
+func (client *fakeClient) Publish(topic string, _ byte, _ bool, payload interface{}) mqtt.Token {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	client.published[topic] = payload.([]byte)
+	return doneToken{}
+}
+
+func (client *fakeClient) reset() {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	client.published = make(map[string][]byte)
+}
+
+// viaDevices returns the via_device of every discovery config published
+// for the device with the given id.
+func (client *fakeClient) viaDevices(t *testing.T, id string) []string {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	var via []string
+	for topic, payload := range client.published {
+		if !strings.Contains(topic, id) || !strings.HasSuffix(topic, "/config") {
+			continue
+		}
+
+		conf := struct {
+			Device homeassistant.DeviceConfig `json:"device"`
+		}{}
+		if err := json.Unmarshal(payload, &conf); err != nil {
+			t.Fatalf("invalid discovery config on %s: %v", topic, err)
+		}
+		if conf.Device.ViaDevice == nil {
+			via = append(via, "")
+		} else {
+			via = append(via, *conf.Device.ViaDevice)
+		}
+	}
+
+	return via
+}
+
+// fakeGateway is a gateway whose MAC is only known once connected.
+type fakeGateway struct {
+	gateway.Gateway
+
+	name string
+	mac  string
+}
+
+func (gw *fakeGateway) Name() string    { return gw.name }
+func (gw *fakeGateway) Mac() string     { return gw.mac }
+func (gw *fakeGateway) Version() string { return "test" }
+
+func TestAnnounceRoutedAfterMissingGatewayConnects(t *testing.T) {
+	conf, err := config.Load(strings.NewReader(`
+devices:
+  - type: ht
+    mac: 0123456789ab
+  - type: ht
+    mac: ba9876543210
+    gateway: present
+`))
+	if err != nil {
+		t.Fatalf("config.Load() = %v", err)
+	}
+
+	layout := defaultLayout(t)
+	state := openStore("")
+	pl, err := buildPipeline(conf, layout, state)
+	if err != nil {
+		t.Fatalf("buildPipeline() = %v", err)
+	}
+	manifest := newDiscoveryManifest(layout)
+	client := newFakeClient()
+
+	missing := &fakeGateway{name: "missing"}
+	present := &fakeGateway{name: "present", mac: "0a0b0c0d0e0f"}
+	gws := newGateways()
+	gws.add(missing)
+	gws.add(present)
+	gws.prefer("ba9876543210", "present")
+
+	for mac := range pl.devices {
+		announceDevice(client, manifest, mac, pl.configuration(mac, gateway.DeviceId(gws.route(mac))))
+	}
+	for _, via := range client.viaDevices(t, "protonht-0123456789ab") {
+		if via != "" {
+			t.Fatalf("device announced with via_device %q before its gateway connected", via)
+		}
+	}
+
+	client.reset()
+	missing.mac = "010203040506"
+	announce := announceGateway(client, layout, state, manifest, missing)
+	if announce() {
+		t.Errorf("gateway announced again with an unchanged MAC")
+	}
+	announceRouted(client, state, manifest, pl, gws, missing)
+
+	via := client.viaDevices(t, "protonht-0123456789ab")
+	if len(via) == 0 {
+		t.Fatalf("device routed through the connected gateway not announced again")
+	}
+	for _, id := range via {
+		if id != "protongw-010203040506" {
+			t.Errorf("via_device = %q, want protongw-010203040506", id)
+		}
+	}
+	if others := client.viaDevices(t, "protonht-ba9876543210"); len(others) != 0 {
+		t.Errorf("device routed through another gateway announced again")
+	}
+}
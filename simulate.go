@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"flag"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"proton-gateway/simulator"
+	"syscall"
+)
+
+func simulate(args []string) {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	listen := flags.String("listen", ":4000", "address to serve the gateway protocol on")
+	scenarioFile := flags.String("scenario", "scenario.yaml", "scenario describing simulated sensors and faults")
+	_ = flags.Parse(args)
+
+	file, err := os.Open(*scenarioFile)
+	if err != nil {
+		log.Fatalf("error opening %s: %v", *scenarioFile, err)
+	}
+
+	scenario, err := simulator.LoadScenario(file)
+	if err != nil {
+		log.Fatalf("error loading scenario: %v", err)
+	}
+	_ = file.Close()
+
+	sim, err := simulator.New(scenario)
+	if err != nil {
+		log.Fatalf("error creating simulator: %v", err)
+	}
+	go sim.Run()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		sim.Close()
+	}()
+
+	log.Infof("simulating gateway with %d sensors on %s", len(scenario.Sensors), *listen)
+	if err := sim.Listen(*listen); err != nil && ctx.Err() == nil {
+		log.Fatalf("simulator stopped: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package simulator
+
+import (
+	"io"
+)
+
+// link decouples reading from the gateway's side of the connection, so a
+// pending CmdAwait can be abandoned as soon as the next command arrives,
+// just like the firmware does.
+type link struct {
+	io.Writer
+
+	incoming chan byte
+	err      error
+	unread   []byte
+}
+
+func newLink(rw io.ReadWriter) *link {
+	l := &link{
+		Writer:   rw,
+		incoming: make(chan byte, 256),
+	}
+
+	go func() {
+		buffer := make([]byte, 256)
+		for {
+			n, err := rw.Read(buffer)
+			for _, b := range buffer[:n] {
+				l.incoming <- b
+			}
+			if err != nil {
+				l.err = err
+				close(l.incoming)
+				return
+			}
+		}
+	}()
+
+	return l
+}
+
+func (l *link) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	n := copy(p, l.unread)
+	l.unread = l.unread[n:]
+	if n > 0 {
+		return n, nil
+	}
+
+	b, ok := <-l.incoming
+	if !ok {
+		return 0, l.err
+	}
+	p[n] = b
+	n++
+
+	for n < len(p) {
+		select {
+		case b, ok := <-l.incoming:
+			if !ok {
+				return n, nil
+			}
+			p[n] = b
+			n++
+		default:
+			return n, nil
+		}
+	}
+
+	return n, nil
+}
+
+// next waits for the first byte of the gateway's next command without
+// consuming it.
+func (l *link) next() <-chan byte {
+	return l.incoming
+}
+
+func (l *link) pushBack(b byte) {
+	l.unread = append(l.unread, b)
+}
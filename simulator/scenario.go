@@ -0,0 +1,59 @@
+package simulator
+
+import (
+	"github.com/creasty/defaults"
+	"gopkg.in/yaml.v2"
+	"io"
+	"time"
+)
+
+// Scenario describes the simulated gateway. A non-zero seed makes the
+// sensor drift and the faults reproducible.
+type Scenario struct {
+	Mac      string         `yaml:"mac" default:"fedcba987654"`
+	Version  string         `yaml:"version" default:"0.0.0-sim"`
+	Rssi     bool           `yaml:"rssi"`
+	Checksum string         `yaml:"checksum" default:"none"`
+	Sensors  []SensorConfig `yaml:"sensors" default:"[]"`
+	Faults   FaultConfig    `yaml:"faults"`
+	Seed     int64          `yaml:"seed"`
+}
+
+type SensorConfig struct {
+	Mac         string        `yaml:"mac"`
+	Interval    time.Duration `yaml:"interval" default:"1m"`
+	Temperature float32       `yaml:"temperature" default:"21.5"`
+	Humidity    float32       `yaml:"humidity" default:"45"`
+	Voltage     float32       `yaml:"voltage" default:"3.9"`
+	Current     float32       `yaml:"current" default:"12"`
+	Rssi        int8          `yaml:"rssi" default:"-70"`
+}
+
+// FaultConfig holds the probability (0..1) of each fault being injected
+// into a reply.
+type FaultConfig struct {
+	OutOfSync float64 `yaml:"out_of_sync"`
+	Timeout   float64 `yaml:"timeout"`
+	Truncate  float64 `yaml:"truncate"`
+	Corrupt   float64 `yaml:"corrupt"`
+}
+
+func LoadScenario(reader io.Reader) (*Scenario, error) {
+	scenario := Scenario{}
+
+	if err := defaults.Set(&scenario); err != nil {
+		return nil, err
+	}
+
+	if err := yaml.NewDecoder(reader).Decode(&scenario); err != nil {
+		return nil, err
+	}
+
+	for i := range scenario.Sensors {
+		if err := defaults.Set(&scenario.Sensors[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return &scenario, nil
+}
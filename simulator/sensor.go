@@ -0,0 +1,53 @@
+package simulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"proton-gateway/utils"
+	"time"
+)
+
+type sensor struct {
+	mac      []byte
+	interval time.Duration
+	rssi     int8
+
+	temperature float32
+	humidity    float32
+	voltage     float32
+	current     float32
+}
+
+func newSensor(conf SensorConfig) (*sensor, error) {
+	mac, err := utils.ParseMac(conf.Mac)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sensor{
+		mac:         mac,
+		interval:    conf.Interval,
+		rssi:        conf.Rssi,
+		temperature: conf.Temperature,
+		humidity:    conf.Humidity,
+		voltage:     conf.Voltage,
+		current:     conf.Current,
+	}, nil
+}
+
+// next returns the HT payload for the current readings and lets them
+// drift slightly so consecutive frames differ.
+func (s *sensor) next(random *rand.Rand) []byte {
+	buffer := bytes.Buffer{}
+	_ = binary.Write(&buffer, binary.LittleEndian, s.temperature)
+	_ = binary.Write(&buffer, binary.LittleEndian, s.humidity)
+	_ = binary.Write(&buffer, binary.LittleEndian, s.voltage)
+	_ = binary.Write(&buffer, binary.LittleEndian, s.current)
+
+	s.temperature += float32(random.NormFloat64() * 0.1)
+	s.humidity += float32(random.NormFloat64() * 0.2)
+	s.voltage -= 0.0001
+
+	return buffer.Bytes()
+}
@@ -0,0 +1,383 @@
+package simulator
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math/rand"
+	"net"
+	"proton-gateway/gateway"
+	"proton-gateway/packet"
+	"proton-gateway/transport"
+	"proton-gateway/utils"
+	"sync"
+	"time"
+)
+
+type Fault int
+
+const (
+	FaultNone Fault = iota
+	FaultOutOfSync
+	FaultTimeout
+	FaultTruncate
+	FaultCorrupt
+)
+
+const (
+	syncMagic     = 0x0055ffaa
+	maxQueueDepth = 255
+)
+
+type frame struct {
+	mac     []byte
+	payload []byte
+	rssi    int8
+}
+
+// Simulator is a software stand-in for the gateway firmware. It answers
+// the command protocol spoken by gateway.ProtonGateway and emits frames
+// for a set of fake HT sensors.
+type Simulator struct {
+	mac      []byte
+	version  string
+	rssi     bool
+	checksum packet.Checksum
+	sensors  []*sensor
+	faults   FaultConfig
+
+	lock     sync.Mutex
+	queue    []frame
+	injected []Fault
+	random   *rand.Rand
+	arrived  chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func New(scenario *Scenario) (*Simulator, error) {
+	mac, err := utils.ParseMac(scenario.Mac)
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := packet.ParseChecksum(scenario.Checksum)
+	if err != nil {
+		return nil, err
+	}
+
+	seed := scenario.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	sim := &Simulator{
+		mac:      mac,
+		version:  scenario.Version,
+		rssi:     scenario.Rssi,
+		checksum: checksum,
+		faults:   scenario.Faults,
+		random:   rand.New(rand.NewSource(seed)),
+		arrived:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+
+	for _, conf := range scenario.Sensors {
+		s, err := newSensor(conf)
+		if err != nil {
+			return nil, err
+		}
+		sim.sensors = append(sim.sensors, s)
+	}
+
+	return sim, nil
+}
+
+// Run emits a frame for every sensor at its configured interval until
+// Close is called.
+func (sim *Simulator) Run() {
+	wg := sync.WaitGroup{}
+	for _, s := range sim.sensors {
+		wg.Add(1)
+		go func(s *sensor) {
+			defer wg.Done()
+			sim.emit(s)
+		}(s)
+	}
+
+	wg.Wait()
+}
+
+func (sim *Simulator) emit(s *sensor) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		sim.lock.Lock()
+		payload := s.next(sim.random)
+		sim.lock.Unlock()
+		sim.Enqueue(s.mac, payload, s.rssi)
+
+		select {
+		case <-ticker.C:
+		case <-sim.stop:
+			return
+		}
+	}
+}
+
+// Enqueue makes a frame available to the next CmdRead as if it had been
+// received over the air with the given signal strength.
+func (sim *Simulator) Enqueue(mac []byte, payload []byte, rssi int8) {
+	sim.lock.Lock()
+	if len(sim.queue) < maxQueueDepth {
+		sim.queue = append(sim.queue, frame{mac: mac, payload: payload, rssi: rssi})
+	}
+	sim.lock.Unlock()
+
+	select {
+	case sim.arrived <- struct{}{}:
+	default:
+	}
+}
+
+// Inject forces fault onto the next reply, regardless of the scenario's
+// fault probabilities.
+func (sim *Simulator) Inject(fault Fault) {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+
+	sim.injected = append(sim.injected, fault)
+}
+
+// Close stops the sensors and the listener. Closing again has no effect.
+func (sim *Simulator) Close() {
+	sim.stopOnce.Do(func() {
+		close(sim.stop)
+	})
+}
+
+// Pipe returns an in-memory transport connected to the simulator.
+func (sim *Simulator) Pipe() transport.Transport {
+	client, server := net.Pipe()
+	go func() {
+		_ = sim.Serve(server)
+		_ = server.Close()
+	}()
+
+	return transport.FromConn(client)
+}
+
+// Listen serves the gateway protocol to every TCP client connecting to
+// address, so the bridge can use it through a tcp:// transport.
+func (sim *Simulator) Listen(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-sim.stop
+		_ = listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			_ = sim.Serve(conn)
+			_ = conn.Close()
+		}()
+	}
+}
+
+// Serve answers gateway commands read from rw until it fails.
+func (sim *Simulator) Serve(conn io.ReadWriter) error {
+	rw := newLink(conn)
+	for {
+		var cmd gateway.Cmd
+		if err := binary.Read(rw, binary.LittleEndian, &cmd); err != nil {
+			return err
+		}
+
+		var err error
+		switch cmd {
+		case gateway.CmdSynchronize:
+			err = sim.synchronize(rw)
+		case gateway.CmdMessageCount:
+			err = sim.messageCount(rw)
+		case gateway.CmdRead:
+			err = sim.read(rw)
+		case gateway.CmdAwait:
+			err = sim.await(rw)
+		case gateway.CmdReadMac:
+			err = sim.readMac(rw)
+		case gateway.CmdSend:
+			err = sim.receive(rw)
+		case gateway.CmdReadVersion:
+			err = sim.readVersion(rw)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (sim *Simulator) synchronize(w io.Writer) error {
+	switch sim.fault() {
+	case FaultTimeout:
+		return nil
+	case FaultOutOfSync:
+		sim.lock.Lock()
+		word := sim.random.Uint32()
+		sim.lock.Unlock()
+		return binary.Write(w, binary.BigEndian, word)
+	default:
+		return binary.Write(w, binary.BigEndian, uint32(syncMagic))
+	}
+}
+
+func (sim *Simulator) messageCount(w io.Writer) error {
+	if sim.fault() == FaultTimeout {
+		return nil
+	}
+
+	sim.lock.Lock()
+	count := uint8(len(sim.queue))
+	sim.lock.Unlock()
+
+	return binary.Write(w, binary.LittleEndian, count)
+}
+
+func (sim *Simulator) read(w io.Writer) error {
+	fault := sim.fault()
+	if fault == FaultTimeout {
+		return nil
+	}
+
+	sim.lock.Lock()
+	if len(sim.queue) == 0 {
+		sim.lock.Unlock()
+		return nil
+	}
+	next := sim.queue[0]
+	sim.queue = sim.queue[1:]
+	sim.lock.Unlock()
+
+	data := make([]byte, 0, len(next.mac)+1+len(next.payload))
+	data = append(data, next.mac...)
+	data = append(data, uint8(len(next.payload)))
+	data = append(data, next.payload...)
+	if sim.rssi {
+		data = append(data, byte(next.rssi))
+	}
+	data = append(data, sim.checksum.Sum(data)...)
+
+	switch fault {
+	case FaultTruncate:
+		data = data[:len(data)-len(next.payload)/2]
+	case FaultCorrupt:
+		data[len(data)/2] ^= 0x10
+	}
+
+	_, err := w.Write(data)
+	return err
+}
+
+// await replies once a frame is queued. Like the firmware it gives up
+// silently when the gateway moves on to the next command.
+func (sim *Simulator) await(l *link) error {
+	if sim.fault() == FaultTimeout {
+		return nil
+	}
+
+	for {
+		sim.lock.Lock()
+		pending := len(sim.queue)
+		sim.lock.Unlock()
+
+		if pending > 0 {
+			return binary.Write(l, binary.LittleEndian, uint8(0x00))
+		}
+
+		select {
+		case <-sim.arrived:
+		case b, ok := <-l.next():
+			if !ok {
+				return l.err
+			}
+			l.pushBack(b)
+			return nil
+		case <-sim.stop:
+			return io.EOF
+		}
+	}
+}
+
+func (sim *Simulator) readMac(w io.Writer) error {
+	if sim.fault() == FaultTimeout {
+		return nil
+	}
+
+	_, err := w.Write(sim.mac)
+	return err
+}
+
+func (sim *Simulator) readVersion(w io.Writer) error {
+	if sim.fault() == FaultTimeout {
+		return nil
+	}
+
+	data := append([]byte{uint8(len(sim.version))}, sim.version...)
+	_, err := w.Write(data)
+	return err
+}
+
+func (sim *Simulator) receive(rw io.ReadWriter) error {
+	mac := make([]byte, 6)
+	if _, err := io.ReadFull(rw, mac); err != nil {
+		return err
+	}
+	var length uint8
+	if err := binary.Read(rw, binary.LittleEndian, &length); err != nil {
+		return err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(rw, payload); err != nil {
+		return err
+	}
+
+	if sim.fault() == FaultTimeout {
+		return nil
+	}
+
+	log.Infof("simulator received packet for %s: %s", hex.EncodeToString(mac), hex.EncodeToString(payload))
+	return binary.Write(rw, binary.LittleEndian, uint8(0x00))
+}
+
+func (sim *Simulator) fault() Fault {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+
+	if len(sim.injected) > 0 {
+		fault := sim.injected[0]
+		sim.injected = sim.injected[1:]
+		return fault
+	}
+
+	roll := sim.random.Float64()
+	switch {
+	case roll < sim.faults.OutOfSync:
+		return FaultOutOfSync
+	case roll < sim.faults.OutOfSync+sim.faults.Timeout:
+		return FaultTimeout
+	case roll < sim.faults.OutOfSync+sim.faults.Timeout+sim.faults.Truncate:
+		return FaultTruncate
+	case roll < sim.faults.OutOfSync+sim.faults.Timeout+sim.faults.Truncate+sim.faults.Corrupt:
+		return FaultCorrupt
+	default:
+		return FaultNone
+	}
+}
@@ -0,0 +1,182 @@
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"proton-gateway/config"
+	"proton-gateway/gateway"
+	"proton-gateway/packet"
+	"proton-gateway/transport"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pipes hands the simulator of the running test to gateways opened through
+// the sim:// scheme.
+var pipes = make(chan *Simulator, 1)
+
+func init() {
+	transport.RegisterScheme("sim", func(string, int) (transport.Transport, error) {
+		return (<-pipes).Pipe(), nil
+	})
+	log.SetOutput(io.Discard)
+}
+
+func newTestSimulator(t *testing.T, scenario string) *Simulator {
+	t.Helper()
+
+	loaded, err := LoadScenario(strings.NewReader(scenario))
+	if err != nil {
+		t.Fatalf("LoadScenario() = %v", err)
+	}
+	sim, err := New(loaded)
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	t.Cleanup(sim.Close)
+
+	return sim
+}
+
+// openGateway opens a gateway connected to sim through Pipe.
+func openGateway(t *testing.T, sim *Simulator, gatewayConfig string) gateway.Gateway {
+	t.Helper()
+
+	conf, err := config.Load(strings.NewReader(gatewayConfig))
+	if err != nil {
+		t.Fatalf("config.Load() = %v", err)
+	}
+
+	pipes <- sim
+	gw, err := gateway.OpenGateway(conf.Gateways[0])
+	if err != nil {
+		t.Fatalf("OpenGateway() = %v", err)
+	}
+	t.Cleanup(func() {
+		_ = gw.Close()
+	})
+
+	return gw
+}
+
+// start runs gw until the test ends, stopping it once ctx is done.
+func start(t *testing.T, ctx context.Context, gw gateway.Gateway, handler gateway.PacketHandler) {
+	ctx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		_ = gw.Start(ctx, handler)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+}
+
+const testGateway = `
+gateways:
+  - name: sim
+    port: sim://test
+    checksum: crc16
+    rssi: true
+    timeouts:
+      default: 100ms
+      await: 50ms
+`
+
+func TestGatewayReceivesThroughPipe(t *testing.T) {
+	sim := newTestSimulator(t, "mac: fedcba987654\nversion: 1.2.3\nchecksum: crc16\nrssi: true\n")
+	gw := openGateway(t, sim, testGateway)
+
+	if mac := gw.Mac(); mac != "fedcba987654" {
+		t.Errorf("Mac() = %q, want fedcba987654", mac)
+	}
+	if version := gw.Version(); version != "1.2.3" {
+		t.Errorf("Version() = %q, want 1.2.3", version)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sim.Enqueue([]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab}, []byte{0xde, 0xad, 0xff}, -70)
+
+	received := make(chan packet.Packet, 1)
+	start(t, ctx, gw, func(p packet.Packet) {
+		select {
+		case received <- p:
+		default:
+		}
+	})
+
+	select {
+	case p := <-received:
+		if p.Mac() != "0123456789ab" {
+			t.Errorf("Mac() = %q, want 0123456789ab", p.Mac())
+		}
+		if payload := hex.EncodeToString(p.Payload()); payload != "deadff" {
+			t.Errorf("Payload() = %s, want deadff", payload)
+		}
+		if p.Rssi() != -70 {
+			t.Errorf("Rssi() = %d, want -70", p.Rssi())
+		}
+	case <-ctx.Done():
+		t.Fatalf("no packet received")
+	}
+}
+
+func TestGatewaySendsThroughPipe(t *testing.T) {
+	sim := newTestSimulator(t, "checksum: crc16\nrssi: true\n")
+	gw := openGateway(t, sim, testGateway)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	connected := make(chan struct{})
+	gw.OnStateChange(func(state gateway.State) {
+		if state == gateway.StateConnected {
+			close(connected)
+		}
+	})
+	start(t, ctx, gw, func(packet.Packet) {})
+
+	select {
+	case <-connected:
+	case <-ctx.Done():
+		t.Fatalf("gateway not connected")
+	}
+
+	if err := gw.Send(ctx, "0123456789ab", []byte{0x01, 0x02}); err != nil {
+		t.Errorf("Send() = %v", err)
+	}
+}
+
+func TestSeedReproducesFaults(t *testing.T) {
+	replies := make([][]byte, 2)
+	for i := range replies {
+		sim := newTestSimulator(t, "seed: 42\n")
+		sim.Inject(FaultOutOfSync)
+
+		reply := bytes.Buffer{}
+		if err := sim.synchronize(&reply); err != nil {
+			t.Fatalf("synchronize() = %v", err)
+		}
+		replies[i] = reply.Bytes()
+	}
+
+	if !bytes.Equal(replies[0], replies[1]) {
+		t.Errorf("out of sync replies % x and % x differ with the same seed", replies[0], replies[1])
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	sim := newTestSimulator(t, "mac: fedcba987654\n")
+
+	sim.Close()
+	sim.Close()
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+// Store keeps small pieces of state, like last values and counters, across
+// restarts. Values are encoded as JSON; changes become durable on Flush.
+type Store interface {
+	Get(key string, value interface{}) (bool, error)
+	Set(key string, value interface{}) error
+	Delete(key string)
+	Flush() error
+}
+
+type jsonStore struct {
+	lock   sync.Mutex
+	path   string
+	values map[string]json.RawMessage
+	dirty  bool
+}
+
+// Open loads the JSON snapshot at path, starting empty if it does not exist
+// yet. An empty path gives a store which is never written to disk.
+func Open(path string) (Store, error) {
+	s := &jsonStore{
+		path:   path,
+		values: make(map[string]json.RawMessage),
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &s.values); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *jsonStore) Get(key string, value interface{}) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, found := s.values[key]
+	if !found {
+		return false, nil
+	}
+
+	return true, json.Unmarshal(data, value)
+}
+
+func (s *jsonStore) Set(key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.values[key] = data
+	s.dirty = true
+	return nil
+}
+
+func (s *jsonStore) Delete(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, found := s.values[key]; found {
+		delete(s.values, key)
+		s.dirty = true
+	}
+}
+
+// Flush writes the snapshot if anything changed since the last flush. The
+// snapshot is written next to the target and renamed over it, so a crash
+// never leaves a half written file behind.
+func (s *jsonStore) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.dirty || s.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(s.values)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	s.dirty = false
+	return nil
+}
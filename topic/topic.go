@@ -0,0 +1,267 @@
+package topic
+
+import (
+	"errors"
+	"fmt"
+	"proton-gateway/config"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+const (
+	DefaultBase         = "protons"
+	DefaultPrefix       = "homeassistant"
+	DefaultState        = "{{ .base }}/{{ .id }}/state"
+	DefaultAvailability = "{{ .base }}/{{ .id }}/status"
+	DefaultCommand      = "{{ .base }}/{{ .id }}/set"
+	DefaultDiscovery    = "{{ .prefix }}/{{ .component }}/{{ .id }}/{{ .field }}/config"
+)
+
+var ErrInvalidTemplate = errors.New("topic: invalid template")
+var ErrInvalidTopic = errors.New("topic: topic not usable")
+
+// discoveryPattern matches the discovery topics below the prefix the way Home
+// Assistant parses them.
+var discoveryPattern = regexp.MustCompile(`^\w+/(?:[a-zA-Z0-9_-]+/)?[a-zA-Z0-9_-]+/config$`)
+
+// Device describes a device to the topic templates. Name defaults to Id.
+type Device struct {
+	Mac  string
+	Type string
+	Name string
+	Id   string
+}
+
+func NewDevice(conf config.DeviceConfig, id string) Device {
+	return Device{Mac: conf.Mac, Type: conf.Type, Name: conf.Name, Id: id}
+}
+
+// Layout renders the topics of devices from text/template templates, which
+// see the variables mac, type, name and id of the device, base and, for
+// discovery topics, field, component and prefix. The layout is built once
+// from the configuration and handed to everything publishing topics.
+type Layout struct {
+	base         string
+	prefix       string
+	state        *template.Template
+	availability *template.Template
+	command      *template.Template
+	discovery    *template.Template
+}
+
+// Topics are the topics used by one device, gateway or the bridge itself,
+// named by owner in errors. Discovery lists its discovery topics.
+type Topics struct {
+	Owner     string
+	Topics    []string
+	Discovery []string
+}
+
+// NewLayout parses the templates, taking the defaults for those left empty.
+// Templates have to tell devices apart, discovery topics also fields and
+// components, and discovery topics have to stay below the prefix, where Home
+// Assistant looks for them, while the base must not.
+func NewLayout(conf config.TopicsConfig) (*Layout, error) {
+	layout := &Layout{
+		base:   orDefault(conf.Base, DefaultBase),
+		prefix: orDefault(conf.DiscoveryPrefix, DefaultPrefix),
+	}
+
+	if strings.ContainsAny(layout.base, "+#") || strings.HasSuffix(layout.base, "/") {
+		return nil, fmt.Errorf("%w: base %s is not a topic", ErrInvalidTemplate, layout.base)
+	}
+	if layout.IsDiscovery(layout.Join("bridge")) {
+		return nil, fmt.Errorf("%w: base %s is below prefix %s", ErrInvalidTemplate, layout.base, layout.prefix)
+	}
+
+	var err error
+	if layout.state, err = parse("state", conf.State, DefaultState); err != nil {
+		return nil, err
+	}
+	if layout.availability, err = parse("availability", conf.Availability, DefaultAvailability); err != nil {
+		return nil, err
+	}
+	if layout.command, err = parse("command", conf.Command, DefaultCommand); err != nil {
+		return nil, err
+	}
+	if layout.discovery, err = parse("discovery", conf.Discovery, DefaultDiscovery); err != nil {
+		return nil, err
+	}
+
+	if err := layout.checkTemplates(); err != nil {
+		return nil, err
+	}
+
+	return layout, nil
+}
+
+// checkTemplates renders the topics of two sample devices, which have to
+// differ in every topic, and the discovery topics of their fields, which
+// have to name the component they are rendered for.
+func (layout *Layout) checkTemplates() error {
+	samples := []Device{
+		{Mac: "0123456789ab", Type: "ht", Name: "First", Id: "protonht-0123456789ab"},
+		{Mac: "ba9876543210", Type: "ht", Name: "Second", Id: "protonht-ba9876543210"},
+	}
+
+	var owners []Topics
+	for _, device := range samples {
+		topics := Topics{Owner: "device " + device.Mac}
+		for _, tmpl := range []*template.Template{layout.state, layout.availability, layout.command} {
+			deviceTopic, err := layout.render(tmpl, layout.vars(device, "", ""))
+			if err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrInvalidTemplate, tmpl.Name(), err)
+			}
+			topics.Topics = append(topics.Topics, deviceTopic)
+		}
+
+		for _, component := range []string{"sensor", "binary_sensor"} {
+			for _, field := range []string{"temperature", "humidity"} {
+				discoveryTopic, err := layout.render(layout.discovery, layout.vars(device, component, field))
+				if err != nil {
+					return fmt.Errorf("%w: discovery: %v", ErrInvalidTemplate, err)
+				}
+				if !strings.HasPrefix(discoveryTopic, layout.prefix+"/"+component+"/") {
+					return fmt.Errorf("%w: discovery topic %s is not <prefix>/%s/[<node id>/]<object id>/config", ErrInvalidTemplate, discoveryTopic, component)
+				}
+				topics.Discovery = append(topics.Discovery, discoveryTopic)
+			}
+		}
+		owners = append(owners, topics)
+	}
+
+	return layout.check(ErrInvalidTemplate, owners...)
+}
+
+// Check fails unless every topic has a single owner and a single use, only
+// discovery topics are below the prefix, and every discovery topic is one
+// Home Assistant parses as <prefix>/<component>/[<node id>/]<object
+// id>/config. Names used by the templates have to fit in there as well.
+func (layout *Layout) Check(owners ...Topics) error {
+	return layout.check(ErrInvalidTopic, owners...)
+}
+
+// check reports failures of Check as invalid.
+func (layout *Layout) check(invalid error, owners ...Topics) error {
+	used := make(map[string]string)
+	claim := func(topic string, owner string) error {
+		if topic == "" || strings.ContainsAny(topic, "+#") {
+			return fmt.Errorf("%w: topic %q of %s is not usable", invalid, topic, owner)
+		}
+		if other, found := used[topic]; found {
+			if other == owner {
+				return fmt.Errorf("%w: topic %s is used twice by %s", invalid, topic, owner)
+			}
+			return fmt.Errorf("%w: topic %s is shared by %s and %s", invalid, topic, other, owner)
+		}
+		used[topic] = owner
+		return nil
+	}
+
+	for _, owner := range owners {
+		for _, ownTopic := range owner.Topics {
+			if err := claim(ownTopic, owner.Owner); err != nil {
+				return err
+			}
+			if layout.IsDiscovery(ownTopic) {
+				return fmt.Errorf("%w: topic %s of %s is below prefix %s", invalid, ownTopic, owner.Owner, layout.prefix)
+			}
+		}
+
+		for _, discoveryTopic := range owner.Discovery {
+			if err := claim(discoveryTopic, owner.Owner); err != nil {
+				return err
+			}
+			if !layout.IsDiscovery(discoveryTopic) {
+				return fmt.Errorf("%w: discovery topic %s of %s is not below prefix %s", invalid, discoveryTopic, owner.Owner, layout.prefix)
+			}
+			if !discoveryPattern.MatchString(strings.TrimPrefix(discoveryTopic, layout.prefix+"/")) {
+				return fmt.Errorf("%w: discovery topic %s of %s is not <prefix>/<component>/[<node id>/]<object id>/config", invalid, discoveryTopic, owner.Owner)
+			}
+		}
+	}
+
+	return nil
+}
+
+func parse(name string, text string, fallback string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(orDefault(text, fallback))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidTemplate, name, err)
+	}
+
+	return tmpl, nil
+}
+
+func orDefault(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+
+	return value
+}
+
+func (layout *Layout) vars(device Device, component string, field string) map[string]string {
+	return map[string]string{
+		"mac":       device.Mac,
+		"type":      device.Type,
+		"name":      orDefault(device.Name, device.Id),
+		"id":        device.Id,
+		"field":     field,
+		"component": component,
+		"prefix":    layout.prefix,
+		"base":      layout.base,
+	}
+}
+
+func (layout *Layout) render(tmpl *template.Template, vars map[string]string) (string, error) {
+	topic := strings.Builder{}
+	if err := tmpl.Execute(&topic, vars); err != nil {
+		return "", err
+	}
+
+	return topic.String(), nil
+}
+
+// mustRender renders a template checked by NewLayout, which only fails for
+// templates failing on some values, like an index out of range.
+func (layout *Layout) mustRender(tmpl *template.Template, vars map[string]string) string {
+	topic, err := layout.render(tmpl, vars)
+	if err != nil {
+		panic(fmt.Errorf("%w: %s: %v", ErrInvalidTemplate, tmpl.Name(), err))
+	}
+
+	return topic
+}
+
+func (layout *Layout) State(device Device) string {
+	return layout.mustRender(layout.state, layout.vars(device, "", ""))
+}
+
+func (layout *Layout) Availability(device Device) string {
+	return layout.mustRender(layout.availability, layout.vars(device, "", ""))
+}
+
+func (layout *Layout) Command(device Device) string {
+	return layout.mustRender(layout.command, layout.vars(device, "", ""))
+}
+
+func (layout *Layout) Discovery(component string, device Device, field string) string {
+	return layout.mustRender(layout.discovery, layout.vars(device, component, field))
+}
+
+func (layout *Layout) Prefix() string {
+	return layout.prefix
+}
+
+// Join returns the topic of the bridge made of parts below the base, like
+// protons/bridge/status.
+func (layout *Layout) Join(parts ...string) string {
+	return strings.Join(append([]string{layout.base}, parts...), "/")
+}
+
+// IsDiscovery reports whether a topic is below the discovery prefix.
+func (layout *Layout) IsDiscovery(topic string) bool {
+	return strings.HasPrefix(topic, layout.prefix+"/")
+}
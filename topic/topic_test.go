@@ -0,0 +1,125 @@
+package topic
+
+import (
+	"errors"
+	"proton-gateway/config"
+	"testing"
+)
+
+func TestNewLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    config.TopicsConfig
+		wantErr error
+	}{
+		{"defaults", config.TopicsConfig{}, nil},
+		{"by name", config.TopicsConfig{
+			State:     "{{ .base }}/{{ .name }}",
+			Discovery: "{{ .prefix }}/{{ .component }}/{{ .id }}_{{ .field }}/config",
+		}, nil},
+		{"node id", config.TopicsConfig{Discovery: "{{ .prefix }}/{{ .component }}/{{ .mac }}/{{ .field }}/config"}, nil},
+		{"base with wildcard", config.TopicsConfig{Base: "protons/#"}, ErrInvalidTemplate},
+		{"base with trailing slash", config.TopicsConfig{Base: "protons/"}, ErrInvalidTemplate},
+		{"base below prefix", config.TopicsConfig{Base: "homeassistant/protons"}, ErrInvalidTemplate},
+		{"syntax", config.TopicsConfig{State: "{{ .base }}/{{ .id"}, ErrInvalidTemplate},
+		{"unknown variable", config.TopicsConfig{State: "{{ .base }}/{{ .serial }}/state"}, ErrInvalidTemplate},
+		{"shared by devices", config.TopicsConfig{State: "{{ .base }}/state"}, ErrInvalidTemplate},
+		{"state is availability", config.TopicsConfig{Availability: "{{ .base }}/{{ .id }}/state"}, ErrInvalidTemplate},
+		{"state below prefix", config.TopicsConfig{State: "{{ .prefix }}/{{ .id }}/state"}, ErrInvalidTemplate},
+		{"discovery without field", config.TopicsConfig{Discovery: "{{ .prefix }}/{{ .component }}/{{ .id }}/config"}, ErrInvalidTemplate},
+		{"discovery of one component", config.TopicsConfig{Discovery: "{{ .prefix }}/sensor/{{ .id }}/{{ .field }}/config"}, ErrInvalidTemplate},
+		{"discovery outside prefix", config.TopicsConfig{Discovery: "{{ .base }}/{{ .component }}/{{ .id }}/{{ .field }}/config"}, ErrInvalidTemplate},
+		{"discovery too deep", config.TopicsConfig{Discovery: "{{ .prefix }}/{{ .component }}/{{ .type }}/{{ .id }}/{{ .field }}/config"}, ErrInvalidTemplate},
+		{"discovery without config", config.TopicsConfig{Discovery: "{{ .prefix }}/{{ .component }}/{{ .id }}/{{ .field }}"}, ErrInvalidTemplate},
+		{"discovery by name", config.TopicsConfig{Discovery: "{{ .prefix }}/{{ .component }}/{{ .name }}/{{ .field }}/config"}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewLayout(test.conf)
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("NewLayout() = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestLayoutTopics(t *testing.T) {
+	layout, err := NewLayout(config.TopicsConfig{
+		Base:            "bridge",
+		DiscoveryPrefix: "ha",
+		Command:         "{{ .base }}/{{ .type }}/{{ .name }}/set",
+	})
+	if err != nil {
+		t.Fatalf("NewLayout() = %v", err)
+	}
+
+	device := Device{Mac: "0123456789ab", Type: "ht", Id: "protonht-0123456789ab"}
+	tests := []struct {
+		name  string
+		topic string
+		want  string
+	}{
+		{"state", layout.State(device), "bridge/protonht-0123456789ab/state"},
+		{"availability", layout.Availability(device), "bridge/protonht-0123456789ab/status"},
+		{"command with name defaulting to id", layout.Command(device), "bridge/ht/protonht-0123456789ab/set"},
+		{"discovery", layout.Discovery("sensor", device, "temperature"), "ha/sensor/protonht-0123456789ab/temperature/config"},
+		{"join", layout.Join("bridge", "status"), "bridge/bridge/status"},
+	}
+
+	for _, test := range tests {
+		if test.topic != test.want {
+			t.Errorf("%s topic = %q, want %q", test.name, test.topic, test.want)
+		}
+	}
+}
+
+func TestLayoutCheck(t *testing.T) {
+	layout, err := NewLayout(config.TopicsConfig{})
+	if err != nil {
+		t.Fatalf("NewLayout() = %v", err)
+	}
+
+	gateway := Topics{Owner: "gateway attic", Topics: []string{"protons/gateway-attic/state", "protons/gateway-attic/diagnostics"}}
+	device := func(topics ...string) Topics {
+		return Topics{Owner: "device 0123456789ab", Topics: topics}
+	}
+
+	tests := []struct {
+		name    string
+		owners  []Topics
+		wantErr error
+	}{
+		{"distinct", []Topics{
+			gateway,
+			device("protons/kitchen/state", "protons/kitchen/status"),
+			{Owner: "device ba9876543210", Topics: []string{"protons/attic/state"}, Discovery: []string{
+				"homeassistant/sensor/attic/temperature/config",
+				"homeassistant/sensor/attic/temperature_5m_min/config",
+			}},
+		}, nil},
+		{"taking a gateway topic", []Topics{gateway, device("protons/gateway-attic/state")}, ErrInvalidTopic},
+		{"shared by devices", []Topics{
+			device("protons/kitchen/state"),
+			{Owner: "device ba9876543210", Topics: []string{"protons/kitchen/state"}},
+		}, ErrInvalidTopic},
+		{"used twice", []Topics{device("protons/kitchen/state", "protons/kitchen/state")}, ErrInvalidTopic},
+		{"shared discovery topic", []Topics{{Owner: "device 0123456789ab", Discovery: []string{
+			"homeassistant/sensor/kitchen/temperature/config",
+			"homeassistant/sensor/kitchen/temperature/config",
+		}}}, ErrInvalidTopic},
+		{"wildcard", []Topics{device("protons/kitchen+/state")}, ErrInvalidTopic},
+		{"empty", []Topics{device("")}, ErrInvalidTopic},
+		{"state below prefix", []Topics{device("homeassistant/kitchen/state")}, ErrInvalidTopic},
+		{"discovery outside prefix", []Topics{{Owner: "device 0123456789ab", Discovery: []string{"protons/sensor/kitchen/temperature/config"}}}, ErrInvalidTopic},
+		{"discovery with spaces", []Topics{{Owner: "device 0123456789ab", Discovery: []string{"homeassistant/sensor/living room/temperature/config"}}}, ErrInvalidTopic},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := layout.Check(test.owners...); !errors.Is(err, test.wantErr) {
+				t.Errorf("Check() = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
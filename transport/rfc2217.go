@@ -0,0 +1,252 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	telnetSe   = 240
+	telnetSb   = 250
+	telnetWill = 251
+	telnetWont = 252
+	telnetDo   = 253
+	telnetDont = 254
+	telnetIac  = 255
+
+	optionBinary          = 0
+	optionSuppressGoAhead = 3
+	optionComPort         = 44
+)
+
+const (
+	comPortSetBaudRate = 1
+	comPortSetDataSize = 2
+	comPortSetParity   = 3
+	comPortSetStopSize = 4
+	comPortPurgeData   = 12
+
+	comPortParityNone   = 1
+	comPortStopSizeOne  = 1
+	comPortPurgeReceive = 1
+)
+
+type telnetState int
+
+const (
+	stateData telnetState = iota
+	stateIac
+	stateOption
+	stateSubnegotiation
+	stateSubnegotiationIac
+)
+
+type rfc2217Transport struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeLock sync.Mutex
+	state     telnetState
+	verb      byte
+}
+
+// OpenRfc2217 connects to a telnet based serial server (RFC 2217) and
+// configures the remote port to baudRate 8N1.
+func OpenRfc2217(address string, baudRate int) (Transport, error) {
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &rfc2217Transport{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+
+	if err := t.negotiate(baudRate); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *rfc2217Transport) negotiate(baudRate int) error {
+	commands := [][]byte{
+		{telnetIac, telnetWill, optionBinary},
+		{telnetIac, telnetDo, optionBinary},
+		{telnetIac, telnetWill, optionSuppressGoAhead},
+		{telnetIac, telnetDo, optionSuppressGoAhead},
+		{telnetIac, telnetWill, optionComPort},
+	}
+	for _, command := range commands {
+		if err := t.writeRaw(command); err != nil {
+			return err
+		}
+	}
+
+	baud := make([]byte, 4)
+	binary.BigEndian.PutUint32(baud, uint32(baudRate))
+	if err := t.subnegotiate(comPortSetBaudRate, baud...); err != nil {
+		return err
+	}
+	if err := t.subnegotiate(comPortSetDataSize, 8); err != nil {
+		return err
+	}
+	if err := t.subnegotiate(comPortSetParity, comPortParityNone); err != nil {
+		return err
+	}
+
+	return t.subnegotiate(comPortSetStopSize, comPortStopSizeOne)
+}
+
+func (t *rfc2217Transport) subnegotiate(command byte, value ...byte) error {
+	frame := []byte{telnetIac, telnetSb, optionComPort, command}
+	frame = append(frame, escape(value)...)
+	frame = append(frame, telnetIac, telnetSe)
+
+	return t.writeRaw(frame)
+}
+
+func (t *rfc2217Transport) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && (n == 0 || t.reader.Buffered() > 0) {
+		b, err := t.reader.ReadByte()
+		if err != nil {
+			return n, err
+		}
+
+		data, isData, err := t.consume(b)
+		if err != nil {
+			return n, err
+		}
+		if isData {
+			p[n] = data
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// consume feeds one byte from the wire through the telnet state machine and
+// reports whether it was a payload byte.
+func (t *rfc2217Transport) consume(b byte) (byte, bool, error) {
+	switch t.state {
+	case stateData:
+		if b == telnetIac {
+			t.state = stateIac
+			return 0, false, nil
+		}
+		return b, true, nil
+	case stateIac:
+		switch b {
+		case telnetIac:
+			t.state = stateData
+			return b, true, nil
+		case telnetWill, telnetWont, telnetDo, telnetDont:
+			t.verb = b
+			t.state = stateOption
+		case telnetSb:
+			t.state = stateSubnegotiation
+		default:
+			t.state = stateData
+		}
+	case stateOption:
+		t.state = stateData
+		return 0, false, t.answer(t.verb, b)
+	case stateSubnegotiation:
+		if b == telnetIac {
+			t.state = stateSubnegotiationIac
+		}
+	case stateSubnegotiationIac:
+		if b == telnetSe {
+			t.state = stateData
+		} else {
+			t.state = stateSubnegotiation
+		}
+	}
+
+	return 0, false, nil
+}
+
+func (t *rfc2217Transport) answer(verb byte, option byte) error {
+	supported := option == optionBinary || option == optionSuppressGoAhead || option == optionComPort
+
+	switch verb {
+	case telnetDo:
+		if !supported {
+			return t.writeRaw([]byte{telnetIac, telnetWont, option})
+		}
+	case telnetWill:
+		if !supported {
+			return t.writeRaw([]byte{telnetIac, telnetDont, option})
+		}
+	}
+
+	return nil
+}
+
+func (t *rfc2217Transport) Write(p []byte) (int, error) {
+	if err := t.writeRaw(escape(p)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (t *rfc2217Transport) writeRaw(p []byte) error {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	_, err := t.conn.Write(p)
+	return err
+}
+
+func (t *rfc2217Transport) Flush() error {
+	if err := t.subnegotiate(comPortPurgeData, comPortPurgeReceive); err != nil {
+		return err
+	}
+
+	buffer := make([]byte, 256)
+	for {
+		if err := t.conn.SetReadDeadline(time.Now().Add(drainWindow)); err != nil {
+			return err
+		}
+
+		_, err := t.Read(buffer)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return err
+		}
+	}
+
+	return t.conn.SetReadDeadline(time.Time{})
+}
+
+func (t *rfc2217Transport) SetReadDeadline(deadline time.Time) error {
+	return t.conn.SetReadDeadline(deadline)
+}
+
+func (t *rfc2217Transport) Close() error {
+	return t.conn.Close()
+}
+
+func escape(p []byte) []byte {
+	escaped := make([]byte, 0, len(p))
+	for _, b := range p {
+		if b == telnetIac {
+			escaped = append(escaped, telnetIac)
+		}
+		escaped = append(escaped, b)
+	}
+
+	return escaped
+}
@@ -0,0 +1,180 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newPipeRfc2217 connects a transport to the peer end of a net.Pipe.
+func newPipeRfc2217(t *testing.T) (*rfc2217Transport, net.Conn) {
+	conn, peer := net.Pipe()
+	t.Cleanup(func() {
+		_ = conn.Close()
+		_ = peer.Close()
+	})
+
+	return &rfc2217Transport{conn: conn, reader: bufio.NewReader(conn)}, peer
+}
+
+// expect reads len(want) bytes from the peer end and compares them. It runs
+// on the peer goroutine, so it does not stop the test.
+func expect(t *testing.T, peer net.Conn, want []byte) {
+	t.Helper()
+
+	_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(peer, got); err != nil {
+		t.Errorf("reading peer: %v", err)
+		return
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("peer received % x, want % x", got, want)
+	}
+}
+
+func TestRfc2217Read(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks [][]byte
+		want   []byte
+	}{
+		{"plain data", [][]byte{{0x01, 0x02}}, []byte{0x01, 0x02}},
+		{"escaped iac", [][]byte{{0x01, telnetIac, telnetIac, 0x02}}, []byte{0x01, 0xff, 0x02}},
+		{"iac split across reads", [][]byte{{0x01, telnetIac}, {telnetIac, 0x02}}, []byte{0x01, 0xff, 0x02}},
+		{"subnegotiation", [][]byte{{telnetIac, telnetSb, optionComPort, 101, 0x01, telnetIac, telnetSe, 0x42}}, []byte{0x42}},
+		{"split subnegotiation", [][]byte{
+			{0x41, telnetIac, telnetSb, optionComPort},
+			{101, telnetIac},
+			{telnetIac, 0x01, telnetIac},
+			{telnetSe, 0x42},
+		}, []byte{0x41, 0x42}},
+		{"supported option", [][]byte{{telnetIac, telnetWill, optionBinary, 0x42}}, []byte{0x42}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport, peer := newPipeRfc2217(t)
+			go func() {
+				for _, chunk := range test.chunks {
+					if _, err := peer.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+
+			_ = transport.SetReadDeadline(time.Now().Add(time.Second))
+			got := make([]byte, len(test.want))
+			if _, err := io.ReadFull(transport, got); err != nil {
+				t.Fatalf("Read() = %v", err)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("Read() = % x, want % x", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRfc2217RefusesUnsupportedOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		verb byte
+		want []byte
+	}{
+		{"do", telnetDo, []byte{telnetIac, telnetWont, 24}},
+		{"will", telnetWill, []byte{telnetIac, telnetDont, 24}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport, peer := newPipeRfc2217(t)
+			go func() {
+				_, _ = peer.Write([]byte{telnetIac, test.verb, 24})
+				expect(t, peer, test.want)
+				_, _ = peer.Write([]byte{0x42})
+			}()
+
+			_ = transport.SetReadDeadline(time.Now().Add(time.Second))
+			got := make([]byte, 1)
+			if _, err := io.ReadFull(transport, got); err != nil {
+				t.Fatalf("Read() = %v", err)
+			}
+			if got[0] != 0x42 {
+				t.Errorf("Read() = % x, want 42", got)
+			}
+		})
+	}
+}
+
+func TestRfc2217WriteEscapesIac(t *testing.T) {
+	transport, peer := newPipeRfc2217(t)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		expect(t, peer, []byte{0x01, telnetIac, telnetIac, 0x02})
+	}()
+
+	if n, err := transport.Write([]byte{0x01, 0xff, 0x02}); err != nil || n != 3 {
+		t.Errorf("Write() = %d, %v, want 3, nil", n, err)
+	}
+	<-done
+}
+
+func TestRfc2217Negotiate(t *testing.T) {
+	transport, peer := newPipeRfc2217(t)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		expect(t, peer, []byte{
+			telnetIac, telnetWill, optionBinary,
+			telnetIac, telnetDo, optionBinary,
+			telnetIac, telnetWill, optionSuppressGoAhead,
+			telnetIac, telnetDo, optionSuppressGoAhead,
+			telnetIac, telnetWill, optionComPort,
+			// 0x0000ffff with both 0xff escaped
+			telnetIac, telnetSb, optionComPort, comPortSetBaudRate, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, telnetIac, telnetSe,
+			telnetIac, telnetSb, optionComPort, comPortSetDataSize, 8, telnetIac, telnetSe,
+			telnetIac, telnetSb, optionComPort, comPortSetParity, comPortParityNone, telnetIac, telnetSe,
+			telnetIac, telnetSb, optionComPort, comPortSetStopSize, comPortStopSizeOne, telnetIac, telnetSe,
+		})
+	}()
+
+	if err := transport.negotiate(0xffff); err != nil {
+		t.Fatalf("negotiate() = %v", err)
+	}
+	<-done
+}
+
+func TestRfc2217FlushPurgesAndDrains(t *testing.T) {
+	transport, peer := newPipeRfc2217(t)
+
+	flushed := make(chan struct{})
+	go func() {
+		expect(t, peer, []byte{telnetIac, telnetSb, optionComPort, comPortPurgeData, comPortPurgeReceive, telnetIac, telnetSe})
+		// stale bytes, partly in a subnegotiation, are drained by Flush
+		_, _ = peer.Write([]byte{0x01, telnetIac, telnetSb, optionComPort})
+		_, _ = peer.Write([]byte{112, 0x00, telnetIac, telnetSe, 0x02})
+
+		<-flushed
+		_, _ = peer.Write([]byte{0x42})
+	}()
+
+	if err := transport.Flush(); err != nil {
+		t.Fatalf("Flush() = %v", err)
+	}
+	close(flushed)
+
+	_ = transport.SetReadDeadline(time.Now().Add(time.Second))
+	got := make([]byte, 1)
+	if _, err := io.ReadFull(transport, got); err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	if got[0] != 0x42 {
+		t.Errorf("Read() after Flush() = % x, want 42", got)
+	}
+}
@@ -0,0 +1,73 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"github.com/tarm/serial"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// pollInterval bounds a single blocking read so deadlines can be enforced
+// on ports that have no native deadline support.
+const pollInterval = 100 * time.Millisecond
+
+var ErrNoSuchPort = errors.New("transport: no matching serial port")
+
+type serialTransport struct {
+	*serial.Port
+	deadline time.Time
+}
+
+func OpenSerial(name string, baudRate int) (Transport, error) {
+	path, err := resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := serial.OpenPort(&serial.Config{Name: path, Baud: baudRate, ReadTimeout: pollInterval})
+	if err != nil {
+		return nil, err
+	}
+
+	return &serialTransport{Port: port}, nil
+}
+
+func (t *serialTransport) Read(p []byte) (int, error) {
+	for {
+		n, err := t.Port.Read(p)
+		if n > 0 || (err != nil && err != io.EOF) {
+			return n, err
+		}
+
+		if !t.deadline.IsZero() && time.Now().After(t.deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (t *serialTransport) SetReadDeadline(deadline time.Time) error {
+	t.deadline = deadline
+	return nil
+}
+
+// resolve expands a pattern like /dev/ttyUSB* so a stick is found again
+// after USB re-enumeration moved it to a different device node.
+func resolve(name string) (string, error) {
+	if !strings.ContainsAny(name, "*?[") {
+		return name, nil
+	}
+
+	matches, err := filepath.Glob(name)
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("%w: %s", ErrNoSuchPort, name)
+	}
+
+	return matches[0], nil
+}
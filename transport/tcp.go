@@ -0,0 +1,59 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	dialTimeout = 5 * time.Second
+	drainWindow = 10 * time.Millisecond
+)
+
+type tcpTransport struct {
+	net.Conn
+}
+
+// OpenTcp connects to a raw TCP serial bridge such as ser2net or esp-link.
+// The baud rate is configured on the bridge itself and therefore ignored.
+func OpenTcp(address string, _ int) (Transport, error) {
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return tcpTransport{Conn: conn}, nil
+}
+
+func (t tcpTransport) Flush() error {
+	return drain(t.Conn)
+}
+
+// drain discards everything the peer has sent so far, which is the closest
+// a socket gets to flushing the receive buffer of a serial port.
+func drain(conn net.Conn) error {
+	buffer := make([]byte, 256)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(drainWindow)); err != nil {
+			return err
+		}
+
+		_, err := conn.Read(buffer)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return err
+		}
+	}
+
+	return conn.SetReadDeadline(time.Time{})
+}
+
+// FromConn wraps an established stream connection, e.g. one end of a
+// net.Pipe, as a Transport.
+func FromConn(conn net.Conn) Transport {
+	return tcpTransport{Conn: conn}
+}
@@ -0,0 +1,65 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Transport carries the gateway protocol. Reads past the deadline set by
+// SetReadDeadline fail with an error wrapping os.ErrDeadlineExceeded.
+type Transport interface {
+	io.ReadWriteCloser
+	Flush() error
+	SetReadDeadline(deadline time.Time) error
+}
+
+type Opener func(address string, baudRate int) (Transport, error)
+
+var ErrUnknownScheme = errors.New("transport: unknown scheme")
+
+var openers map[string]Opener
+
+func RegisterScheme(scheme string, opener Opener) {
+	openers[scheme] = opener
+}
+
+// Open selects a transport by the scheme of address. Plain device paths
+// without a scheme are opened as local serial ports.
+func Open(address string, baudRate int) (Transport, error) {
+	scheme, target := split(address)
+
+	opener, found := openers[scheme]
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownScheme, scheme)
+	}
+
+	return opener(target, baudRate)
+}
+
+func split(address string) (string, string) {
+	if !strings.Contains(address, "://") {
+		return "serial", address
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", address
+	}
+
+	if u.Host != "" {
+		return u.Scheme, u.Host
+	}
+
+	return u.Scheme, u.Path
+}
+
+func init() {
+	openers = make(map[string]Opener)
+	RegisterScheme("serial", OpenSerial)
+	RegisterScheme("tcp", OpenTcp)
+	RegisterScheme("rfc2217", OpenRfc2217)
+}
@@ -0,0 +1,50 @@
+package transport
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		address    string
+		wantScheme string
+		wantTarget string
+	}{
+		{"/dev/ttyUSB0", "serial", "/dev/ttyUSB0"},
+		{"COM3", "serial", "COM3"},
+		{"serial:///dev/ttyUSB0", "serial", "/dev/ttyUSB0"},
+		{"tcp://10.0.0.5:4000", "tcp", "10.0.0.5:4000"},
+		{"rfc2217://gateway.local:4000", "rfc2217", "gateway.local:4000"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			scheme, target := split(test.address)
+			if scheme != test.wantScheme || target != test.wantTarget {
+				t.Errorf("split() = %q, %q, want %q, %q", scheme, target, test.wantScheme, test.wantTarget)
+			}
+		})
+	}
+}
+
+func TestOpenSelectsScheme(t *testing.T) {
+	var opened string
+	var baudRate int
+	RegisterScheme("test", func(address string, rate int) (Transport, error) {
+		opened, baudRate = address, rate
+		return nil, nil
+	})
+	defer delete(openers, "test")
+
+	if _, err := Open("test://device:1", 9600); err != nil {
+		t.Fatalf("Open() = %v", err)
+	}
+	if opened != "device:1" || baudRate != 9600 {
+		t.Errorf("opened %q at %d, want %q at 9600", opened, baudRate, "device:1")
+	}
+
+	if _, err := Open("unknown://device", 9600); !errors.Is(err, ErrUnknownScheme) {
+		t.Errorf("Open() = %v, want %v", err, ErrUnknownScheme)
+	}
+}
@@ -2,9 +2,13 @@ package utils
 
 import (
 	"encoding/hex"
+	"errors"
 	"io"
+	"strings"
 )
 
+var ErrInvalidMac = errors.New("utils: invalid mac address")
+
 func ReadMac(reader io.Reader) (*string, error) {
 	bytes := make([]byte, 6)
 	read := 0
@@ -18,3 +22,23 @@ func ReadMac(reader io.Reader) (*string, error) {
 	mac := hex.EncodeToString(bytes)
 	return &mac, nil
 }
+
+func ParseMac(mac string) ([]byte, error) {
+	bytes, err := hex.DecodeString(mac)
+	if err != nil || len(bytes) != 6 {
+		return nil, ErrInvalidMac
+	}
+
+	return bytes, nil
+}
+
+// NormalizeMac returns mac as twelve lower case hex digits, the form packets
+// report it in. Colons and dashes between the octets are dropped.
+func NormalizeMac(mac string) (string, error) {
+	bytes, err := ParseMac(strings.NewReplacer(":", "", "-", "").Replace(mac))
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(bytes), nil
+}
@@ -0,0 +1,113 @@
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"proton-gateway/message"
+	"proton-gateway/store"
+	"sync"
+	"time"
+)
+
+// Watchdog marks devices offline once they stayed silent for longer than
+// their timeout. A device is considered online again as soon as it is seen;
+// publishing "online" is left to the device itself.
+type Watchdog struct {
+	lock    sync.Mutex
+	emit    func(msg message.Message)
+	state   store.Store
+	devices map[string]*watched
+}
+
+type watched struct {
+	timeout  time.Duration
+	lastSeen time.Time
+	online   bool
+	offline  func() []message.Message
+}
+
+func New(emit func(msg message.Message), state store.Store) *Watchdog {
+	return &Watchdog{
+		emit:    emit,
+		state:   state,
+		devices: make(map[string]*watched),
+	}
+}
+
+// Watch starts tracking mac. Devices count as seen when they are added,
+// unless the store remembers when they were actually seen last, so a device
+// which went silent before a restart is not reported online for another
+// timeout. A zero timeout disables the watchdog for the device.
+func (w *Watchdog) Watch(mac string, timeout time.Duration, offline func() []message.Message) {
+	if timeout <= 0 {
+		return
+	}
+
+	lastSeen := time.Now()
+	var seen time.Time
+	if found, _ := w.state.Get(lastSeenKey(mac), &seen); found && seen.Before(lastSeen) {
+		lastSeen = seen
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.devices[mac] = &watched{
+		timeout:  timeout,
+		lastSeen: lastSeen,
+		online:   true,
+		offline:  offline,
+	}
+}
+
+func (w *Watchdog) Seen(mac string, at time.Time) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	dev, found := w.devices[mac]
+	if !found {
+		return
+	}
+
+	dev.lastSeen = at
+	dev.online = true
+	_ = w.state.Set(lastSeenKey(mac), at)
+}
+
+// Run checks every interval for devices that went silent until ctx is done.
+func (w *Watchdog) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, msg := range w.expired(now) {
+				w.emit(msg)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *Watchdog) expired(now time.Time) []message.Message {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	var messages []message.Message
+	for _, dev := range w.devices {
+		if !dev.online || now.Sub(dev.lastSeen) < dev.timeout {
+			continue
+		}
+
+		dev.online = false
+		messages = append(messages, dev.offline()...)
+	}
+
+	return messages
+}
+
+func lastSeenKey(mac string) string {
+	return fmt.Sprintf("watchdog/%s/last_seen", mac)
+}